@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// The admin API is a set of JSON-RPC style endpoints: every method is a
+// POST to /admin/<method> with a JSON object of parameters, answered with
+// {"result": ...} or an OpenAI-style error. Like the proxy, the admin API
+// operates on the tenant selected by the X-Tenant header.
+
+type adminMethod func(conn *sqlite.Conn, params json.RawMessage) (any, error)
+
+// errAdminParams is returned by admin methods for invalid parameters.
+var errAdminParams = errors.New("invalid parameters")
+
+func decodeAdminParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		params = json.RawMessage("{}")
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return fmt.Errorf("%w: %v", errAdminParams, err)
+	}
+	return nil
+}
+
+type adminUser struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	// Accepts the same formats as set-user-key on input
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Expired   bool   `json:"expired,omitempty"`
+	Note      string `json:"note,omitempty"`
+}
+
+func adminListUsers(conn *sqlite.Conn, params json.RawMessage) (any, error) {
+	users, err := listUsers(conn)
+	if err != nil {
+		return nil, err
+	}
+	res := []adminUser{}
+	for _, u := range users {
+		res = append(res, adminUser{Name: u.name, Key: u.key, ExpiresAt: u.expiresAt, Expired: u.expired, Note: u.note})
+	}
+	return res, nil
+}
+
+func adminSetUserKey(conn *sqlite.Conn, params json.RawMessage) (any, error) {
+	var p adminUser
+	if err := decodeAdminParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Name == "" || p.Key == "" {
+		return nil, fmt.Errorf("%w: name and key are required", errAdminParams)
+	}
+	var expiresAt string
+	if p.ExpiresAt != "" {
+		var err error
+		if expiresAt, err = parseKeyExpiry(p.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("%w: %v", errAdminParams, err)
+		}
+	}
+	if err := setUserKey(conn, p.Name, p.Key, expiresAt); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+func adminSetUserNote(conn *sqlite.Conn, params json.RawMessage) (any, error) {
+	var p struct {
+		Name string `json:"name"`
+		Note string `json:"note"`
+	}
+	if err := decodeAdminParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Name == "" {
+		return nil, fmt.Errorf("%w: name is required", errAdminParams)
+	}
+	found, err := setUserNote(conn, p.Name, p.Note)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: user %s is not found", errAdminParams, p.Name)
+	}
+	return struct{}{}, nil
+}
+
+func (s *server) adminRotateUserKey(conn *sqlite.Conn, params json.RawMessage) (any, error) {
+	var p struct {
+		Name         string `json:"name"`
+		GraceSeconds int    `json:"grace_seconds"`
+	}
+	if err := decodeAdminParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Name == "" || p.GraceSeconds < 0 {
+		return nil, fmt.Errorf("%w: name and non-negative grace_seconds are required", errAdminParams)
+	}
+	key, found, err := rotateUserKey(conn, p.Name, s.keyPrefix, time.Duration(p.GraceSeconds)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: user %s is not found", errAdminParams, p.Name)
+	}
+	return adminUser{Name: p.Name, Key: key}, nil
+}
+
+func adminDeleteUser(conn *sqlite.Conn, params json.RawMessage) (any, error) {
+	var p struct {
+		Name    string `json:"name"`
+		Hard    bool   `json:"hard"`
+		Cascade bool   `json:"cascade"`
+	}
+	if err := decodeAdminParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Name == "" {
+		return nil, fmt.Errorf("%w: name is required", errAdminParams)
+	}
+	if !p.Hard {
+		if p.Cascade {
+			return nil, fmt.Errorf("%w: cascade requires hard", errAdminParams)
+		}
+		deleted, err := softDeleteUser(conn, p.Name)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			Deleted bool `json:"deleted"`
+		}{deleted}, nil
+	}
+	if !p.Cascade {
+		nProjects, err := countUserProjects(conn, p.Name)
+		if err != nil {
+			return nil, err
+		}
+		if nProjects != 0 {
+			return nil, fmt.Errorf("%w: user %s has %d project(s) with usage history, cascade is required", errAdminParams, p.Name, nProjects)
+		}
+	}
+	deleted, err := deleteUser(conn, p.Name, p.Cascade)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Deleted bool `json:"deleted"`
+	}{deleted}, nil
+}
+
+func adminUndeleteUser(conn *sqlite.Conn, params json.RawMessage) (any, error) {
+	var p struct {
+		Name string `json:"name"`
+	}
+	if err := decodeAdminParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Name == "" {
+		return nil, fmt.Errorf("%w: name is required", errAdminParams)
+	}
+	undeleted, err := undeleteUser(conn, p.Name)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Undeleted bool `json:"undeleted"`
+	}{undeleted}, nil
+}
+
+func adminSetModelLimit(conn *sqlite.Conn, params json.RawMessage) (any, error) {
+	var p struct {
+		Model string `json:"model"`
+		RPM   int    `json:"rpm"`
+		TPM   int    `json:"tpm"`
+	}
+	if err := decodeAdminParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Model == "" || p.RPM < 0 || p.TPM < 0 {
+		return nil, fmt.Errorf("%w: model and non-negative rpm and tpm are required", errAdminParams)
+	}
+	if err := setModelLimits(conn, p.Model, p.RPM, p.TPM); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+type adminProjectUsage struct {
+	User     string `json:"user"`
+	Project  string `json:"project"`
+	Tokens   int    `json:"tokens"`
+	Requests int    `json:"requests"`
+}
+
+type adminMonthUsage struct {
+	Month    string              `json:"month"`
+	Projects []adminProjectUsage `json:"projects"`
+}
+
+func adminGetUsage(conn *sqlite.Conn, params json.RawMessage) (any, error) {
+	var p struct {
+		Weighted    bool              `json:"weighted"`
+		GroupModels bool              `json:"group_models_into_projects"`
+		GroupByTag  bool              `json:"group_by_tag"`
+		ProjectGlob string            `json:"project_glob"`
+		IncludeTest bool              `json:"include_test"`
+		Filter      map[string]string `json:"filter"`
+	}
+	if err := decodeAdminParams(params, &p); err != nil {
+		return nil, err
+	}
+	filter, err := parseUsageFilter(p.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errAdminParams, err)
+	}
+	if p.ProjectGlob != "" {
+		filter.projectLike = globToLike(p.ProjectGlob)
+	}
+	filter.includeTest = p.IncludeTest
+	usage, err := getUsage(conn, p.Weighted, p.GroupModels, p.GroupByTag, filter)
+	if err != nil {
+		return nil, err
+	}
+	res := []adminMonthUsage{}
+	for _, mu := range usage {
+		amu := adminMonthUsage{Month: mu.month}
+		for _, pu := range mu.projects {
+			amu.Projects = append(amu.Projects, adminProjectUsage{User: pu.userName, Project: pu.projectName, Tokens: pu.tokens, Requests: pu.requests})
+		}
+		res = append(res, amu)
+	}
+	return res, nil
+}
+
+// adminDrain sets or clears the draining flag that makes /healthz fail,
+// so that load balancers stop routing new requests to this instance.
+func (s *server) adminDrain(conn *sqlite.Conn, params json.RawMessage) (any, error) {
+	p := struct {
+		Draining bool `json:"draining"`
+	}{Draining: true}
+	if err := decodeAdminParams(params, &p); err != nil {
+		return nil, err
+	}
+	s.draining.Store(p.Draining)
+	return p, nil
+}
+
+// invalidatesUsers wraps a method changing user keys to clear the user
+// cache once it succeeds.
+func (s *server) invalidatesUsers(m adminMethod) adminMethod {
+	return func(conn *sqlite.Conn, params json.RawMessage) (any, error) {
+		res, err := m(conn, params)
+		if err == nil && s.userCache != nil {
+			s.userCache.clear()
+		}
+		return res, err
+	}
+}
+
+func (s *server) adminMethods() map[string]adminMethod {
+	return map[string]adminMethod{
+		"list-users":      adminListUsers,
+		"set-user-key":    s.invalidatesUsers(adminSetUserKey),
+		"set-user-note":   adminSetUserNote,
+		"rotate-user-key": s.invalidatesUsers(s.adminRotateUserKey),
+		"delete-user":     s.invalidatesUsers(adminDeleteUser),
+		"undelete-user":   s.invalidatesUsers(adminUndeleteUser),
+		"set-model-limit": adminSetModelLimit,
+		"get-usage":       adminGetUsage,
+		"drain":           s.adminDrain,
+	}
+}
+
+// Admin methods only reading the database, which use the report pool
+var adminReportMethods = map[string]bool{
+	"get-usage": true,
+}
+
+func (s *server) adminAuthorized(r *http.Request) bool {
+	reqToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(reqToken), []byte(s.adminToken)) == 1
+}
+
+func (s *server) adminRequest(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(r) {
+		logError(r, "Admin request with invalid token")
+		httpError(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		logError(r, "Unexpected admin method %q", r.Method)
+		httpError(w, "Only POST requests are supported", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, s.adminPathPrefix+"/admin/")
+	method, ok := s.adminMethods()[name]
+	if !ok {
+		logError(r, "Unknown admin method %q", name)
+		httpError(w, "Unknown method "+name, http.StatusNotFound)
+		return
+	}
+
+	params, err := io.ReadAll(r.Body)
+	if err != nil {
+		logError(r, "Failed to read admin request body: %v", err)
+		httpError(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	tenantName, pool, ok := s.tenantPool(r)
+	if !ok {
+		logError(r, "Unknown tenant %q", tenantName)
+		httpError(w, "Unknown tenant "+tenantName, http.StatusNotFound)
+		return
+	}
+
+	var conn *sqlite.Conn
+	if adminReportMethods[name] && tenantName == "" && s.reportPool != nil {
+		if conn = s.reportPool.Get(ctx); conn == nil {
+			logError(r, "Failed to get report database connection: %v", ctx.Err())
+			httpError(w, "database is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.reportPool.Put(conn)
+	} else {
+		if conn, err = pool.Get(ctx); err != nil {
+			logError(r, "Failed to get database connection: %v", err)
+			httpError(w, "database is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer pool.Put(conn)
+	}
+
+	result, err := method(conn, params)
+	if errors.Is(err, errAdminParams) {
+		logError(r, "Admin %s: %v", name, err)
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logError(r, "Admin %s failed: %v", name, err)
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	logInfo(r, "Admin %s done", name)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Result any `json:"result"`
+	}{result}); err != nil {
+		logError(r, "Failed to write admin response: %v", err)
+	}
+}
+
+func (s *server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.adminPathPrefix+"/admin/", s.adminRequest)
+	return mux
+}
@@ -1,9 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitemigration"
@@ -33,22 +42,152 @@ CREATE TABLE usage (
   project_id INTEGER NOT NULL REFERENCES projects(id),
   tokens INTEGER NOT NULL
 );
+`, `
+ALTER TABLE models ADD COLUMN rpm_limit INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE models ADD COLUMN tpm_limit INTEGER NOT NULL DEFAULT 0;
+`, `
+CREATE TABLE requests (
+  id INTEGER PRIMARY KEY,
+  ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  project_id INTEGER NOT NULL REFERENCES projects(id),
+  model_id INTEGER NOT NULL REFERENCES models(id),
+  status INTEGER NOT NULL
+);
+`, `
+ALTER TABLE requests ADD COLUMN body BLOB;
+ALTER TABLE requests ADD COLUMN body_compressed INTEGER NOT NULL DEFAULT 0;
+`, `
+ALTER TABLE users ADD COLUMN prev_key TEXT;
+ALTER TABLE users ADD COLUMN prev_key_expires_at TIMESTAMP;
+CREATE INDEX users_prev_key ON users(prev_key);
+`, `
+ALTER TABLE models ADD COLUMN multiplier REAL NOT NULL DEFAULT 1;
+`, `
+ALTER TABLE users ADD COLUMN expires_at TIMESTAMP;
+`, `
+-- NULL for usage recorded before streaming was tracked
+ALTER TABLE usage ADD COLUMN streamed INTEGER;
+`, `
+ALTER TABLE users ADD COLUMN note TEXT NOT NULL DEFAULT '';
+`, `
+-- Models a project may use. Projects without rows may use any model.
+CREATE TABLE project_models (
+  project_id INTEGER NOT NULL REFERENCES projects(id),
+  model_id INTEGER NOT NULL REFERENCES models(id),
+  PRIMARY KEY (project_id, model_id)
+);
+`, `
+-- With aggregated usage, a row sums several requests
+ALTER TABLE usage ADD COLUMN requests INTEGER NOT NULL DEFAULT 1;
+CREATE INDEX usage_bucket ON usage(project_id, model_id, ts);
+`, `
+-- Client-supplied X-Idempotency-Key values of requests already charged
+CREATE TABLE idempotency_keys (
+  project_id INTEGER NOT NULL REFERENCES projects(id),
+  key TEXT NOT NULL,
+  ts TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  tokens INTEGER NOT NULL,
+  PRIMARY KEY (project_id, key)
+);
+CREATE INDEX idempotency_keys_ts ON idempotency_keys(ts);
+`, `
+ALTER TABLE users ADD COLUMN rate_limit_rpm INTEGER;
+ALTER TABLE users ADD COLUMN rate_limit_tpm INTEGER;
+`, `
+-- Client-supplied X-Usage-Tag, NULL if absent
+ALTER TABLE usage ADD COLUMN tag TEXT;
+`, `
+-- Hash of the prompt texts, only stored with --store-prompt-hashes
+ALTER TABLE usage ADD COLUMN prompt_hash TEXT;
+CREATE INDEX usage_prompt_hash ON usage(prompt_hash) WHERE prompt_hash IS NOT NULL;
+`, `
+-- Prompt tokens served from OpenAI's prompt cache, included in tokens
+ALTER TABLE usage ADD COLUMN cached_tokens INTEGER NOT NULL DEFAULT 0;
+`, `
+CREATE INDEX usage_ts ON usage(ts, project_id, model_id);
+`, `
+-- Soft-deleted users can't authenticate, but keep their usage history
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP;
+`, `
+-- Usage of requests with the X-Test header, left out of reports by default
+ALTER TABLE usage ADD COLUMN test INTEGER NOT NULL DEFAULT 0;
+`, `
+-- Tokenizer estimate and upstream count of the tokens of requests, only
+-- stored with --store-token-estimates
+ALTER TABLE usage ADD COLUMN estimated_tokens INTEGER;
+ALTER TABLE usage ADD COLUMN reported_tokens INTEGER;
+`, `
+-- Prompt tokens included in tokens, NULL for usage recorded before they
+-- were tracked and for transcriptions. NULL multipliers default to
+-- multiplier.
+ALTER TABLE usage ADD COLUMN prompt_tokens INTEGER;
+ALTER TABLE models ADD COLUMN prompt_multiplier REAL;
+ALTER TABLE models ADD COLUMN completion_multiplier REAL;
+`, `
+-- Hash of the model and body of the request that used the key, NULL for
+-- keys recorded before it was stored
+ALTER TABLE idempotency_keys ADD COLUMN request_hash TEXT;
+`, `
+-- Tokens added to tokens by --min-tokens-per-request, and usage of
+-- passthrough keys billed to the clients' own accounts, to reconcile
+-- with upstream. Unknown for usage recorded before.
+ALTER TABLE usage ADD COLUMN floor_tokens INTEGER;
+ALTER TABLE usage ADD COLUMN passthrough BOOLEAN NOT NULL DEFAULT 0;
+`, `
+-- Seconds of audio of transcriptions billed by duration, which are not
+-- tokens and so are kept out of tokens. Such usage recorded before has
+-- the seconds in tokens.
+ALTER TABLE usage ADD COLUMN audio_seconds INTEGER NOT NULL DEFAULT 0;
 `,
 	},
 }
 
-func newPool() (*sqlitemigration.Pool, error) {
-	pool := sqlitemigration.NewPool("gpt-proxy-split.db", schema, sqlitemigration.Options{
+type dbOptions struct {
+	path string
+	// synchronous is the value of PRAGMA synchronous, empty keeps SQLite's
+	// default (FULL). With WAL, NORMAL never corrupts the database, but
+	// transactions committed just before a power loss or OS crash may be
+	// lost; FULL syncs the WAL on every commit and loses nothing.
+	synchronous string
+}
+
+func newPool(opts dbOptions) (*sqlitemigration.Pool, error) {
+	switch strings.ToUpper(opts.synchronous) {
+	case "", "OFF", "NORMAL", "FULL", "EXTRA":
+	default:
+		return nil, fmt.Errorf("invalid synchronous mode %q", opts.synchronous)
+	}
+
+	pool := sqlitemigration.NewPool(opts.path, schema, sqlitemigration.Options{
 		Flags: sqlite.OpenReadWrite | sqlite.OpenCreate | sqlite.OpenWAL,
 		PrepareConn: func(conn *sqlite.Conn) error {
-			return sqlitex.ExecuteTransient(conn, "PRAGMA foreign_keys = ON;", nil)
+			if err := sqlitex.ExecuteTransient(conn, "PRAGMA foreign_keys = ON;", nil); err != nil {
+				return err
+			}
+			if opts.synchronous != "" {
+				return sqlitex.ExecuteTransient(conn, "PRAGMA synchronous = "+opts.synchronous+";", nil)
+			}
+			return nil
 		},
 	})
 	return pool, nil
 }
 
-func mustNewPool() *sqlitemigration.Pool {
-	pool, err := newPool()
+// Connections of report pools, enough for a few concurrent admin reports
+const reportPoolSize = 4
+
+// newReportPool opens a pool of read-only connections to the database at
+// path for reports. Unlike newPool it does not migrate the schema.
+func newReportPool(path string) (*sqlitex.Pool, error) {
+	pool, err := sqlitex.Open(path, sqlite.OpenReadOnly|sqlite.OpenURI, reportPoolSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return pool, nil
+}
+
+func mustNewPool(opts dbOptions) *sqlitemigration.Pool {
+	pool, err := newPool(opts)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error opening database: %v\n", err)
 		os.Exit(1)
@@ -65,19 +204,297 @@ func mustGetDB(ctx context.Context, pool *sqlitemigration.Pool) *sqlite.Conn {
 	return conn
 }
 
-const insertProjectIDStmt = `INSERT OR IGNORE INTO projects (user_id, name) VALUES (:userID, :name)`
+// checkpointWAL moves all WAL contents into the main database file and
+// truncates the WAL, so nothing is left only in the WAL on shutdown.
+func checkpointWAL(conn *sqlite.Conn) error {
+	if err := sqlitex.ExecuteTransient(conn, "PRAGMA wal_checkpoint(TRUNCATE);", nil); err != nil {
+		return fmt.Errorf("failed to checkpoint WAL: %w", err)
+	}
+	return nil
+}
+
+// checkDB runs SQLite's integrity and foreign key checks and returns the
+// problems found, if any.
+func checkDB(conn *sqlite.Conn) ([]string, error) {
+	var problems []string
+
+	if err := sqlitex.ExecuteTransient(conn, "PRAGMA integrity_check;", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if msg := stmt.ColumnText(0); msg != "ok" {
+				problems = append(problems, msg)
+			}
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to check integrity: %w", err)
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, "PRAGMA foreign_key_check;", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			problems = append(problems, fmt.Sprintf("row %d of %s references missing %s row",
+				stmt.ColumnInt64(1), stmt.ColumnText(0), stmt.ColumnText(2)))
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to check foreign keys: %w", err)
+	}
+
+	return problems, nil
+}
+
+const findOrphanedUsageStmt = `
+SELECT 'project' AS kind, project_id AS id, COUNT(*) AS nRows, SUM(tokens) AS tokens
+FROM usage
+WHERE project_id NOT IN (SELECT id FROM projects)
+GROUP BY project_id
+UNION ALL
+SELECT 'model', model_id, COUNT(*), SUM(tokens)
+FROM usage
+WHERE model_id NOT IN (SELECT id FROM models)
+GROUP BY model_id
+ORDER BY kind DESC, id
+`
+
+// orphanedUsage is the usage referencing a project or model that does not
+// exist.
+type orphanedUsage struct {
+	// "project" or "model"
+	kind   string
+	id     int64
+	rows   int
+	tokens int
+}
+
+// findOrphanedUsage returns the usage referencing missing projects or
+// models, which foreign keys prevent unless they were disabled, e.g. to
+// import data.
+func findOrphanedUsage(conn *sqlite.Conn) ([]orphanedUsage, error) {
+	var orphans []orphanedUsage
+	if err := sqlitex.ExecuteTransient(conn, findOrphanedUsageStmt, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			orphans = append(orphans, orphanedUsage{
+				kind:   stmt.GetText("kind"),
+				id:     stmt.GetInt64("id"),
+				rows:   int(stmt.GetInt64("nRows")),
+				tokens: int(stmt.GetInt64("tokens")),
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to find orphaned usage: %w", err)
+	}
+	return orphans, nil
+}
+
+// Name of the user, project and model orphaned usage is reassigned to
+const orphanedName = "<orphaned>"
+
+// The user is created deleted, so that its random key can't be used
+const insertOrphanedUserStmt = `
+INSERT OR IGNORE INTO users (name, key, deleted_at) VALUES (:name, :apiKey, CURRENT_TIMESTAMP)`
+
+const insertOrphanedProjectStmt = `
+INSERT OR IGNORE INTO projects (user_id, name)
+SELECT id, :name FROM users WHERE name = :name`
+
+const reassignOrphanedProjectsStmt = `
+UPDATE usage SET project_id = (
+  SELECT projects.id FROM projects JOIN users ON users.id = projects.user_id
+  WHERE users.name = :name AND projects.name = :name)
+WHERE project_id NOT IN (SELECT id FROM projects)`
+
+const reassignOrphanedModelsStmt = `
+UPDATE usage SET model_id = (SELECT id FROM models WHERE name = :name)
+WHERE model_id NOT IN (SELECT id FROM models)`
+
+// repairOrphanedUsage reassigns usage referencing missing projects or
+// models to the orphanedName project of the orphanedName user and to the
+// orphanedName model, creating them if needed. It returns the number of
+// references replaced.
+func repairOrphanedUsage(conn *sqlite.Conn) (_ int, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	apiKey, err := newAPIKey()
+	if err != nil {
+		return 0, err
+	}
+	if err := sqlitex.ExecuteTransient(conn, insertOrphanedUserStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":name":   orphanedName,
+			":apiKey": apiKey,
+		},
+	}); err != nil {
+		return 0, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	named := map[string]any{":name": orphanedName}
+	if err := sqlitex.ExecuteTransient(conn, insertOrphanedProjectStmt, &sqlitex.ExecOptions{Named: named}); err != nil {
+		return 0, fmt.Errorf("failed to create project: %w", err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, insertModelIDStmt, &sqlitex.ExecOptions{Named: named}); err != nil {
+		return 0, fmt.Errorf("failed to create model: %w", err)
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, reassignOrphanedProjectsStmt, &sqlitex.ExecOptions{Named: named}); err != nil {
+		return 0, fmt.Errorf("failed to reassign usage of missing projects: %w", err)
+	}
+	n := conn.Changes()
+	if err := sqlitex.ExecuteTransient(conn, reassignOrphanedModelsStmt, &sqlitex.ExecOptions{Named: named}); err != nil {
+		return 0, fmt.Errorf("failed to reassign usage of missing models: %w", err)
+	}
+	return n + conn.Changes(), nil
+}
+
+type tableRows struct {
+	name string
+	rows int
+}
+
+type modelConfig struct {
+	name       string
+	rpmLimit   int
+	tpmLimit   int
+	multiplier float64
+	// Set if the model has separate prompt and completion multipliers
+	splitMultipliers     bool
+	promptMultiplier     float64
+	completionMultiplier float64
+}
+
+// diagnostics describe a database for bug reports, without any keys or
+// other user data.
+type diagnostics struct {
+	// Number of migrations applied
+	schemaVersion int
+	tables        []tableRows
+	models        []modelConfig
+}
+
+const listTablesStmt = `SELECT name FROM sqlite_schema WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`
+const listModelConfigsStmt = `SELECT name, rpm_limit, tpm_limit, multiplier FROM models ORDER BY name`
+const listModelMultipliersStmt = `SELECT name, prompt_multiplier, completion_multiplier FROM models ORDER BY name`
+
+// getDiagnostics reads the diagnostics of a database, which may not be
+// migrated to the current schema yet.
+func getDiagnostics(conn *sqlite.Conn) (diagnostics, error) {
+	var d diagnostics
+
+	if err := sqlitex.ExecuteTransient(conn, "PRAGMA user_version;", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			d.schemaVersion = stmt.ColumnInt(0)
+			return nil
+		},
+	}); err != nil {
+		return diagnostics{}, fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, listTablesStmt, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			d.tables = append(d.tables, tableRows{name: stmt.GetText("name")})
+			return nil
+		},
+	}); err != nil {
+		return diagnostics{}, fmt.Errorf("failed to list tables: %w", err)
+	}
+	for i := range d.tables {
+		t := &d.tables[i]
+		query := `SELECT COUNT(*) FROM "` + strings.ReplaceAll(t.name, `"`, `""`) + `"`
+		if err := sqlitex.ExecuteTransient(conn, query, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				t.rows = stmt.ColumnInt(0)
+				return nil
+			},
+		}); err != nil {
+			return diagnostics{}, fmt.Errorf("failed to count rows of %s: %w", t.name, err)
+		}
+	}
+
+	// The limit and multiplier columns only exist in migrated databases
+	if d.schemaVersion >= 6 {
+		if err := sqlitex.ExecuteTransient(conn, listModelConfigsStmt, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				d.models = append(d.models, modelConfig{
+					name:       stmt.GetText("name"),
+					rpmLimit:   int(stmt.GetInt64("rpm_limit")),
+					tpmLimit:   int(stmt.GetInt64("tpm_limit")),
+					multiplier: stmt.GetFloat("multiplier"),
+				})
+				return nil
+			},
+		}); err != nil {
+			return diagnostics{}, fmt.Errorf("failed to list models: %w", err)
+		}
+	}
+	if d.schemaVersion >= 21 {
+		i := 0
+		if err := sqlitex.ExecuteTransient(conn, listModelMultipliersStmt, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				d.models[i].splitMultipliers = stmt.ColumnType(stmt.ColumnIndex("prompt_multiplier")) != sqlite.TypeNull
+				d.models[i].promptMultiplier = stmt.GetFloat("prompt_multiplier")
+				d.models[i].completionMultiplier = stmt.GetFloat("completion_multiplier")
+				i++
+				return nil
+			},
+		}); err != nil {
+			return diagnostics{}, fmt.Errorf("failed to list model multipliers: %w", err)
+		}
+	}
+
+	return d, nil
+}
+
+// insertProjectIDStmt creates the project unless it exists or the user
+// has :maxProjects projects already (0 means no limit).
+const insertProjectIDStmt = `
+INSERT OR IGNORE INTO projects (user_id, name)
+SELECT :userID, :name
+WHERE :maxProjects = 0 OR (SELECT COUNT(*) FROM projects WHERE user_id = :userID) < :maxProjects`
 const selectProjectIDStmt = `SELECT id FROM projects WHERE user_id = :userID AND name = :name`
 
-func getProjectID(conn *sqlite.Conn, userID int64, projectName string) (int64, error) {
+var (
+	errTooManyProjects = errors.New("too many projects")
+	errProjectNotFound = errors.New("project not found")
+)
+
+// getProjectID returns the ID of the user's project, creating it if
+// necessary. If autocreate is not set, errProjectNotFound is returned
+// instead. If maxProjects is not 0 and the user already has that many
+// projects, a new project is not created and errTooManyProjects is returned.
+//
+// Concurrent first requests for a project may all try to create it, so
+// it is created by a single statement that ignores an existing project.
+// Unlike a select followed by an insert in one transaction, it waits for
+// other writers instead of failing with SQLITE_BUSY.
+func getProjectID(conn *sqlite.Conn, userID int64, projectName string, autocreate bool, maxProjects int) (int64, error) {
+	projectID, err := selectProjectID(conn, userID, projectName)
+	if err != nil || projectID != 0 {
+		return projectID, err
+	}
+	if !autocreate {
+		return 0, errProjectNotFound
+	}
+
 	if err := sqlitex.ExecuteTransient(conn, insertProjectIDStmt, &sqlitex.ExecOptions{
 		Named: map[string]any{
-			":userID": userID,
-			":name":   projectName,
+			":userID":      userID,
+			":name":        projectName,
+			":maxProjects": maxProjects,
 		},
 	}); err != nil {
 		return 0, fmt.Errorf("failed to insert project ID: %w", err)
 	}
 
+	projectID, err = selectProjectID(conn, userID, projectName)
+	if err != nil {
+		return 0, err
+	}
+	if projectID == 0 {
+		return 0, errTooManyProjects
+	}
+	return projectID, nil
+}
+
+func selectProjectID(conn *sqlite.Conn, userID int64, projectName string) (int64, error) {
 	var projectID int64
 	if err := sqlitex.ExecuteTransient(conn, selectProjectIDStmt, &sqlitex.ExecOptions{
 		Named: map[string]any{
@@ -94,6 +511,59 @@ func getProjectID(conn *sqlite.Conn, userID int64, projectName string) (int64, e
 	return projectID, nil
 }
 
+const listUserProjectNamesStmt = `SELECT name FROM projects WHERE user_id = :userID ORDER BY name`
+
+// listUserProjectNames returns the names of the user's projects, sorted.
+func listUserProjectNames(conn *sqlite.Conn, userID int64) ([]string, error) {
+	var names []string
+	if err := sqlitex.ExecuteTransient(conn, listUserProjectNamesStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{":userID": userID},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			names = append(names, stmt.GetText("name"))
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list projects: %w", err)
+	}
+	return names, nil
+}
+
+const selectUserIDStmt = `SELECT id FROM users WHERE name = :userName AND deleted_at IS NULL`
+const insertProjectStmt = `INSERT OR IGNORE INTO projects (user_id, name) VALUES (:userID, :name)`
+
+var (
+	errUserNotFound  = errors.New("user not found")
+	errProjectExists = errors.New("project already exists")
+)
+
+// createProject creates a project of the user, regardless of the
+// per-user project limit of the proxy, restricted to modelNames unless
+// there are none. It fails with errUserNotFound or errProjectExists.
+func createProject(conn *sqlite.Conn, userName, projectName string, modelNames []string) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	userID, found, err := findUserByName(conn, userName)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errUserNotFound
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, insertProjectStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":userID": userID,
+			":name":   projectName,
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to create project: %w", err)
+	}
+	if conn.Changes() == 0 {
+		return errProjectExists
+	}
+	return addProjectModels(conn, conn.LastInsertRowID(), modelNames)
+}
+
 const insertModelIDStmt = `INSERT OR IGNORE INTO models (name) VALUES (:name)`
 const selectModelIDStmt = `SELECT id FROM models WHERE name = :name`
 
@@ -118,147 +588,1867 @@ func getModelID(conn *sqlite.Conn, modelName string) (int64, error) {
 	return modelID, nil
 }
 
-const saveUsageStmt = `INSERT INTO usage (model_id, project_id, tokens) VALUES (:modelID, :projectID, :tokensUsage)`
-
-func saveUsage(conn *sqlite.Conn, modelID int64, projectID int64, tokensUsage int) (err error) {
-	defer sqlitex.Save(conn)(&err)
-
-	if err := sqlitex.ExecuteTransient(conn, saveUsageStmt, &sqlitex.ExecOptions{
-		Named: map[string]any{
-			":modelID":     modelID,
-			":projectID":   projectID,
-			":tokensUsage": tokensUsage,
+// findModelID returns the ID of the model, or 0 if it is not known, without
+// adding it like getModelID.
+func findModelID(conn *sqlite.Conn, modelName string) (int64, error) {
+	var modelID int64
+	if err := sqlitex.ExecuteTransient(conn, selectModelIDStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{":name": modelName},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			modelID = stmt.GetInt64("id")
+			return nil
 		},
 	}); err != nil {
-		return fmt.Errorf("failed to save usage: %w", err)
+		return 0, fmt.Errorf("failed to get model ID: %w", err)
 	}
-
-	return nil
+	return modelID, nil
 }
 
-const listUsersStmt = `SELECT name, key FROM users ORDER BY name`
+// addModels adds the models not known yet and returns their names.
+func addModels(conn *sqlite.Conn, modelNames []string) (_ []string, err error) {
+	defer sqlitex.Save(conn)(&err)
 
-type user struct {
-	name string
-	key  string
+	var added []string
+	for _, modelName := range modelNames {
+		if err := sqlitex.ExecuteTransient(conn, insertModelIDStmt, &sqlitex.ExecOptions{
+			Named: map[string]any{":name": modelName},
+		}); err != nil {
+			return nil, fmt.Errorf("failed to add model %s: %w", modelName, err)
+		}
+		if conn.Changes() != 0 {
+			added = append(added, modelName)
+		}
+	}
+	return added, nil
 }
 
-func listUsers(conn *sqlite.Conn) ([]user, error) {
-	var users []user
+const selectModelLimitsStmt = `SELECT rpm_limit, tpm_limit FROM models WHERE id = :modelID`
 
-	if err := sqlitex.ExecuteTransient(conn, listUsersStmt, &sqlitex.ExecOptions{
+func getModelLimits(conn *sqlite.Conn, modelID int64) (rpm int, tpm int, err error) {
+	if err := sqlitex.ExecuteTransient(conn, selectModelLimitsStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{":modelID": modelID},
 		ResultFunc: func(stmt *sqlite.Stmt) error {
-			var u user
-			u.name = stmt.GetText("name")
-			u.key = stmt.GetText("key")
-			users = append(users, u)
+			rpm = int(stmt.GetInt64("rpm_limit"))
+			tpm = int(stmt.GetInt64("tpm_limit"))
 			return nil
 		},
 	}); err != nil {
-		return nil, fmt.Errorf("failed to list users: %w", err)
+		return 0, 0, fmt.Errorf("failed to get model limits: %w", err)
 	}
+	return rpm, tpm, nil
+}
 
-	return users, nil
+const setModelLimitsStmt = `UPDATE models SET rpm_limit = :rpm, tpm_limit = :tpm WHERE id = :modelID`
+
+func setModelLimits(conn *sqlite.Conn, modelName string, rpm int, tpm int) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	modelID, err := getModelID(conn, modelName)
+	if err != nil {
+		return err
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, setModelLimitsStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":modelID": modelID,
+			":rpm":     rpm,
+			":tpm":     tpm,
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to set model limits: %w", err)
+	}
+
+	return nil
 }
 
-const setUserKeyQuery = `
-INSERT INTO users (name, key)
-VALUES (:userName, :apiKey)
-ON CONFLICT (name) DO UPDATE SET key = :apiKey`
+const setModelMultiplierStmt = `
+UPDATE models SET multiplier = :multiplier, prompt_multiplier = NULL, completion_multiplier = NULL
+WHERE id = :modelID`
 
-func setUserKey(conn *sqlite.Conn, userName string, apiKey string) (err error) {
+// setModelMultiplier sets the multiplier of both prompt and completion
+// tokens of the model.
+func setModelMultiplier(conn *sqlite.Conn, modelName string, multiplier float64) (err error) {
 	defer sqlitex.Save(conn)(&err)
 
-	if err := sqlitex.ExecuteTransient(conn, setUserKeyQuery, &sqlitex.ExecOptions{
+	modelID, err := getModelID(conn, modelName)
+	if err != nil {
+		return err
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, setModelMultiplierStmt, &sqlitex.ExecOptions{
 		Named: map[string]any{
-			":userName": userName,
-			":apiKey":   apiKey,
+			":modelID":    modelID,
+			":multiplier": multiplier,
 		},
 	}); err != nil {
-		return fmt.Errorf("failed to save user/key: %w", err)
+		return fmt.Errorf("failed to set model multiplier: %w", err)
 	}
 
 	return nil
 }
 
-const deleteUserQuery = `DELETE FROM users WHERE name = :userName`
+const setModelSplitMultipliersStmt = `
+UPDATE models SET prompt_multiplier = :promptMultiplier, completion_multiplier = :completionMultiplier
+WHERE id = :modelID`
 
-func deleteUser(conn *sqlite.Conn, userName string) (_ bool, err error) {
+// setModelSplitMultipliers sets separate multipliers of the prompt and
+// completion tokens of the model, which replace its multiplier in weighted
+// reports until it is set again.
+func setModelSplitMultipliers(conn *sqlite.Conn, modelName string, promptMultiplier, completionMultiplier float64) (err error) {
 	defer sqlitex.Save(conn)(&err)
 
-	if err := sqlitex.ExecuteTransient(conn, deleteUserQuery, &sqlitex.ExecOptions{
-		Named: map[string]any{":userName": userName},
+	modelID, err := getModelID(conn, modelName)
+	if err != nil {
+		return err
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, setModelSplitMultipliersStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":modelID":              modelID,
+			":promptMultiplier":     promptMultiplier,
+			":completionMultiplier": completionMultiplier,
+		},
 	}); err != nil {
-		return false, fmt.Errorf("failed to delete user: %w", err)
+		return fmt.Errorf("failed to set model multipliers: %w", err)
 	}
 
-	return conn.Changes() != 0, nil
+	return nil
 }
 
-const findUserByKeyStmt = `SELECT id, name FROM users WHERE KEY = :apiKey`
+// weightedTokensExpr is the cost units of a usage row: its prompt and
+// completion tokens multiplied by the model's multipliers for them, which
+// default to the model's multiplier. Usage recorded without the split,
+// before it was tracked or of transcriptions, is multiplied by the model's
+// multiplier, so that setting split multipliers doesn't change the past.
+// So are seconds of audio, the model's multiplier being their cost.
+const weightedTokensExpr = `(CASE WHEN usage.prompt_tokens IS NULL THEN usage.tokens * models.multiplier
+    ELSE usage.prompt_tokens * IFNULL(models.prompt_multiplier, models.multiplier)
+      + (usage.tokens - usage.prompt_tokens) * IFNULL(models.completion_multiplier, models.multiplier) END
+    + usage.audio_seconds * models.multiplier)`
 
-func findUserByKey(conn *sqlite.Conn, apiKey string) (int64, string, bool, error) {
-	var userID int64
-	var userName string
-	var userFound bool
-	if err := sqlitex.ExecuteTransient(conn, findUserByKeyStmt, &sqlitex.ExecOptions{
-		Named: map[string]any{":apiKey": apiKey},
+const projectModelAllowedStmt = `
+SELECT NOT EXISTS (SELECT 1 FROM project_models WHERE project_id = :projectID)
+  OR EXISTS (SELECT 1 FROM project_models WHERE project_id = :projectID AND model_id = :modelID) AS allowed`
+
+// projectModelAllowed reports whether the project's model allowlist
+// permits the model. An empty allowlist permits any model.
+func projectModelAllowed(conn *sqlite.Conn, projectID int64, modelID int64) (bool, error) {
+	var allowed bool
+	if err := sqlitex.ExecuteTransient(conn, projectModelAllowedStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":projectID": projectID,
+			":modelID":   modelID,
+		},
 		ResultFunc: func(stmt *sqlite.Stmt) error {
-			userID = stmt.GetInt64("id")
-			userName = stmt.GetText("name")
-			userFound = true
+			allowed = stmt.GetBool("allowed")
 			return nil
 		},
 	}); err != nil {
-		return 0, "", false, fmt.Errorf("failed to find user by key: %w", err)
+		return false, fmt.Errorf("failed to check project models: %w", err)
 	}
-
-	return userID, userName, userFound, nil
+	return allowed, nil
 }
 
-const getUsageStmt = `
-SELECT strftime('%Y-%m', usage.ts) AS month,
-  users.name AS userName,
-  projects.name as projectName,
-  SUM(usage.tokens) AS usage
-FROM usage
-JOIN projects ON projects.id = usage.project_id
+const selectProjectIDByNameStmt = `
+SELECT projects.id AS id
+FROM projects
 JOIN users ON users.id = projects.user_id
-GROUP BY month, user_id, project_id
-ORDER BY month, usage DESC, user_id, project_id
-`
-
-type usage struct {
-	month    string
-	projects []projectUsage
-}
+WHERE users.name = :userName AND projects.name = :projectName`
 
-type projectUsage struct {
-	userName    string
-	projectName string
-	tokens      int
-}
+const deleteProjectModelsStmt = `DELETE FROM project_models WHERE project_id = :projectID`
+const insertProjectModelStmt = `INSERT OR IGNORE INTO project_models (project_id, model_id) VALUES (:projectID, :modelID)`
 
-func getUsage(conn *sqlite.Conn) ([]usage, error) {
-	var usages []usage
+// setProjectModels replaces the model allowlist of an existing project.
+// No models removes the allowlist.
+func setProjectModels(conn *sqlite.Conn, userName, projectName string, modelNames []string) (found bool, err error) {
+	defer sqlitex.Save(conn)(&err)
 
-	if err := sqlitex.ExecuteTransient(conn, getUsageStmt, &sqlitex.ExecOptions{
+	var projectID int64
+	if err := sqlitex.ExecuteTransient(conn, selectProjectIDByNameStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":userName":    userName,
+			":projectName": projectName,
+		},
 		ResultFunc: func(stmt *sqlite.Stmt) error {
-			month := stmt.GetText("month")
-			if len(usages) == 0 || usages[len(usages)-1].month != month {
-				usages = append(usages, usage{month: month})
-			}
-			u := &usages[len(usages)-1]
-			u.projects = append(u.projects, projectUsage{
-				userName:    stmt.GetText("userName"),
-				projectName: stmt.GetText("projectName"),
-				tokens:      int(stmt.GetInt64("usage")),
-			})
+			projectID = stmt.GetInt64("id")
+			found = true
 			return nil
 		},
 	}); err != nil {
-		return nil, fmt.Errorf("failed to list usage: %w", err)
+		return false, fmt.Errorf("failed to find project: %w", err)
+	}
+	if !found {
+		return false, nil
 	}
 
-	return usages, nil
+	if err := sqlitex.ExecuteTransient(conn, deleteProjectModelsStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{":projectID": projectID},
+	}); err != nil {
+		return false, fmt.Errorf("failed to clear project models: %w", err)
+	}
+
+	if err := addProjectModels(conn, projectID, modelNames); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// addProjectModels adds models to the allowlist of the project.
+func addProjectModels(conn *sqlite.Conn, projectID int64, modelNames []string) error {
+	for _, modelName := range modelNames {
+		modelID, err := getModelID(conn, modelName)
+		if err != nil {
+			return err
+		}
+		if err := sqlitex.ExecuteTransient(conn, insertProjectModelStmt, &sqlitex.ExecOptions{
+			Named: map[string]any{
+				":projectID": projectID,
+				":modelID":   modelID,
+			},
+		}); err != nil {
+			return fmt.Errorf("failed to add project model: %w", err)
+		}
+	}
+	return nil
+}
+
+const saveUsageStmt = `
+INSERT INTO usage (model_id, project_id, tokens, prompt_tokens, cached_tokens, streamed, tag, prompt_hash, test, estimated_tokens, reported_tokens,
+  floor_tokens, passthrough, audio_seconds)
+VALUES (:modelID, :projectID, :tokensUsage, NULLIF(:promptTokens, 0), :cachedTokens, :streamed, NULLIF(:tag, ''), NULLIF(:promptHash, ''), :test,
+  NULLIF(:estimatedTokens, 0), NULLIF(:reportedTokens, 0), NULLIF(:floorTokens, 0), :passthrough, :audioSeconds)`
+
+// usageBucketExpr is the start of the current usage bucket of :granularity.
+const usageBucketExpr = `CASE :granularity WHEN 'hour' THEN strftime('%Y-%m-%d %H:00:00', 'now') ELSE strftime('%Y-%m-%d 00:00:00', 'now') END`
+
+const addBucketUsageStmt = `
+UPDATE usage SET tokens = tokens + :tokensUsage, prompt_tokens = NULLIF(IFNULL(prompt_tokens, 0) + :promptTokens, 0), cached_tokens = cached_tokens + :cachedTokens, requests = requests + 1,
+  estimated_tokens = CASE :estimatedTokens WHEN 0 THEN estimated_tokens ELSE IFNULL(estimated_tokens, 0) + :estimatedTokens END,
+  reported_tokens = CASE :estimatedTokens WHEN 0 THEN reported_tokens ELSE IFNULL(reported_tokens, 0) + :reportedTokens END,
+  floor_tokens = NULLIF(IFNULL(floor_tokens, 0) + :floorTokens, 0), audio_seconds = audio_seconds + :audioSeconds
+WHERE project_id = :projectID AND model_id = :modelID AND ts = ` + usageBucketExpr + ` AND streamed IS :streamed
+  AND tag IS NULLIF(:tag, '') AND prompt_hash IS NULLIF(:promptHash, '') AND test = :test
+  AND (prompt_tokens IS NULL) = (:promptTokens = 0) AND passthrough = :passthrough`
+
+const insertBucketUsageStmt = `
+INSERT INTO usage (ts, model_id, project_id, tokens, prompt_tokens, cached_tokens, streamed, tag, prompt_hash, test, estimated_tokens, reported_tokens,
+  floor_tokens, passthrough, audio_seconds)
+VALUES (` + usageBucketExpr + `, :modelID, :projectID, :tokensUsage, NULLIF(:promptTokens, 0), :cachedTokens, :streamed, NULLIF(:tag, ''), NULLIF(:promptHash, ''), :test,
+  NULLIF(:estimatedTokens, 0), NULLIF(:reportedTokens, 0), NULLIF(:floorTokens, 0), :passthrough, :audioSeconds)`
+
+// usageRecord is the usage of a single request.
+type usageRecord struct {
+	modelID   int64
+	projectID int64
+	tokens    int
+	// Prompt tokens, included in tokens, 0 if unknown
+	promptTokens int
+	// Prompt tokens served from the prompt cache, included in tokens
+	cachedTokens int
+	streamed     bool
+	// Empty if the request had no X-Usage-Tag
+	tag string
+	// Empty unless prompt hashes are stored
+	promptHash string
+	// Set for test traffic (X-Test header)
+	test bool
+	// Tokenizer estimate of the tokens and the upstream count it is
+	// compared with, 0 unless estimates are stored
+	estimatedTokens int
+	reportedTokens  int
+	// Tokens added by --min-tokens-per-request, included in tokens
+	floorTokens int
+	// Set for requests with passthrough keys, billed to the clients
+	passthrough bool
+	// Seconds of audio of transcriptions billed by duration, which are
+	// not tokens and are not included in tokens
+	audioSeconds int
+}
+
+// Attempts of usage writes failing with SQLITE_BUSY or SQLITE_LOCKED, and
+// the pause after the first one, growing with each attempt
+const (
+	usageWriteAttempts   = 5
+	usageWriteRetryDelay = 20 * time.Millisecond
+)
+
+// isBusy reports whether err is a lock conflict with another connection.
+// The busy handler waits for locks, but a transaction that would
+// deadlock, such as one upgrading a read to a write after another
+// connection wrote, fails at once. Running it again can succeed.
+func isBusy(err error) bool {
+	switch sqlite.ErrCode(err).ToPrimary() {
+	case sqlite.ResultBusy, sqlite.ResultLocked:
+		return true
+	}
+	return false
+}
+
+// retryBusy runs the transaction f until it succeeds, fails with an error
+// other than isBusy, or usageWriteAttempts are made. It must not be used
+// inside another transaction, which would keep its locks across retries.
+func retryBusy(f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !isBusy(err) || attempt == usageWriteAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * usageWriteRetryDelay)
+	}
+}
+
+// saveUsage records the usage of a request, retrying on lock conflicts so
+// that contention does not lose it. With granularity "hour" or "day" it
+// is added to the bucket row of the current period, tag, prompt hash and
+// test flag instead of getting a row of its own.
+func saveUsage(conn *sqlite.Conn, u usageRecord, granularity string) error {
+	return retryBusy(func() error {
+		return saveUsageTx(conn, u, granularity)
+	})
+}
+
+func saveUsageTx(conn *sqlite.Conn, u usageRecord, granularity string) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	opts := &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":modelID":         u.modelID,
+			":projectID":       u.projectID,
+			":tokensUsage":     u.tokens,
+			":promptTokens":    u.promptTokens,
+			":cachedTokens":    u.cachedTokens,
+			":streamed":        u.streamed,
+			":tag":             u.tag,
+			":promptHash":      u.promptHash,
+			":test":            u.test,
+			":estimatedTokens": u.estimatedTokens,
+			":reportedTokens":  u.reportedTokens,
+			":floorTokens":     u.floorTokens,
+			":passthrough":     u.passthrough,
+			":audioSeconds":    u.audioSeconds,
+		},
+	}
+
+	if granularity == "" {
+		if err := sqlitex.ExecuteTransient(conn, saveUsageStmt, opts); err != nil {
+			return fmt.Errorf("failed to save usage: %w", err)
+		}
+		return nil
+	}
+
+	opts.Named[":granularity"] = granularity
+	if err := sqlitex.ExecuteTransient(conn, addBucketUsageStmt, opts); err != nil {
+		return fmt.Errorf("failed to save usage: %w", err)
+	}
+	if conn.Changes() == 0 {
+		if err := sqlitex.ExecuteTransient(conn, insertBucketUsageStmt, opts); err != nil {
+			return fmt.Errorf("failed to save usage: %w", err)
+		}
+	}
+
+	return nil
+}
+
+const expireIdempotencyKeysStmt = `DELETE FROM idempotency_keys WHERE ts <= datetime('now', -:ttlSeconds || ' seconds')`
+
+const insertIdempotencyKeyStmt = `
+INSERT OR IGNORE INTO idempotency_keys (project_id, key, tokens, request_hash)
+VALUES (:projectID, :key, :tokensUsage, :requestHash)`
+
+const getIdempotencyKeyHashStmt = `
+SELECT IFNULL(request_hash, '') AS requestHash FROM idempotency_keys
+WHERE project_id = :projectID AND key = :key AND ts > datetime('now', -:ttlSeconds || ' seconds')`
+
+// getIdempotencyKeyHash returns the request hash recorded with the
+// idempotency key of the project within ttl, "" if there is none or it
+// was recorded without one, and false if the key is not recorded.
+func getIdempotencyKeyHash(conn *sqlite.Conn, projectID int64, idempotencyKey string, ttl time.Duration) (_ string, found bool, _ error) {
+	var requestHash string
+	if err := sqlitex.ExecuteTransient(conn, getIdempotencyKeyHashStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":projectID":  projectID,
+			":key":        idempotencyKey,
+			":ttlSeconds": int64(ttl / time.Second),
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			requestHash, found = stmt.GetText("requestHash"), true
+			return nil
+		},
+	}); err != nil {
+		return "", false, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	return requestHash, found, nil
+}
+
+// saveUsageOnce is saveUsage for requests with a client-supplied
+// idempotency key: usage is only saved the first time the project uses
+// the key within ttl, and the result reports whether it was. Reusing the
+// key for a different request, by requestHash, is charged again.
+func saveUsageOnce(conn *sqlite.Conn, idempotencyKey, requestHash string, ttl time.Duration, u usageRecord, granularity string) (saved bool, err error) {
+	err = retryBusy(func() (err error) {
+		saved, err = saveUsageOnceTx(conn, idempotencyKey, requestHash, ttl, u, granularity)
+		return err
+	})
+	return saved, err
+}
+
+func saveUsageOnceTx(conn *sqlite.Conn, idempotencyKey, requestHash string, ttl time.Duration, u usageRecord, granularity string) (_ bool, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	if err := sqlitex.ExecuteTransient(conn, expireIdempotencyKeysStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{":ttlSeconds": int64(ttl / time.Second)},
+	}); err != nil {
+		return false, fmt.Errorf("failed to expire idempotency keys: %w", err)
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, insertIdempotencyKeyStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":projectID":   u.projectID,
+			":key":         idempotencyKey,
+			":tokensUsage": u.tokens,
+			":requestHash": requestHash,
+		},
+	}); err != nil {
+		return false, fmt.Errorf("failed to record idempotency key: %w", err)
+	}
+	if conn.Changes() == 0 {
+		recordedHash, _, err := getIdempotencyKeyHash(conn, u.projectID, idempotencyKey, ttl)
+		if err != nil {
+			return false, err
+		}
+		if recordedHash == requestHash {
+			return false, nil
+		}
+	}
+
+	if err := saveUsageTx(conn, u, granularity); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+const saveRequestStmt = `
+INSERT INTO requests (project_id, model_id, status, body, body_compressed)
+VALUES (:projectID, :modelID, :status, :body, :bodyCompressed)`
+
+// saveRequest records the outcome of a request forwarded upstream.
+// If body is not nil it is stored too, gzipped if that makes it smaller.
+func saveRequest(conn *sqlite.Conn, modelID int64, projectID int64, status int, body []byte) error {
+	var bodyArg any
+	var bodyCompressed bool
+	if body != nil {
+		bodyArg = body
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return fmt.Errorf("failed to compress request body: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to compress request body: %w", err)
+		}
+		if buf.Len() < len(body) {
+			bodyArg = buf.Bytes()
+			bodyCompressed = true
+		}
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, saveRequestStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":modelID":        modelID,
+			":projectID":      projectID,
+			":status":         status,
+			":body":           bodyArg,
+			":bodyCompressed": bodyCompressed,
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to save request: %w", err)
+	}
+
+	return nil
+}
+
+const listRequestsStmt = `
+SELECT requests.id AS id,
+  requests.ts AS ts,
+  users.name AS userName,
+  projects.name AS projectName,
+  models.name AS modelName,
+  requests.status AS status,
+  requests.body AS body,
+  requests.body_compressed AS bodyCompressed
+FROM requests
+JOIN projects ON projects.id = requests.project_id
+JOIN users ON users.id = projects.user_id
+JOIN models ON models.id = requests.model_id
+WHERE (:from = '' OR requests.ts >= :from) AND (:to = '' OR requests.ts < date(:to, '+1 day'))
+ORDER BY requests.id DESC
+LIMIT :limit
+`
+
+type request struct {
+	id          int64
+	ts          string
+	userName    string
+	projectName string
+	modelName   string
+	status      int
+	// nil if the body was not stored
+	body []byte
+}
+
+// listRequests returns up to limit most recent requests between from and to,
+// with their stored bodies decompressed.
+func listRequests(conn *sqlite.Conn, from, to string, limit int) ([]request, error) {
+	var requests []request
+
+	if err := sqlitex.ExecuteTransient(conn, listRequestsStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":from":  from,
+			":to":    to,
+			":limit": limit,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			req := request{
+				id:          stmt.GetInt64("id"),
+				ts:          stmt.GetText("ts"),
+				userName:    stmt.GetText("userName"),
+				projectName: stmt.GetText("projectName"),
+				modelName:   stmt.GetText("modelName"),
+				status:      int(stmt.GetInt64("status")),
+			}
+			var err error
+			if req.body, err = readRequestBody(stmt, req.id); err != nil {
+				return err
+			}
+			requests = append(requests, req)
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list requests: %w", err)
+	}
+
+	return requests, nil
+}
+
+// readRequestBody returns the decompressed body of the request in the
+// body and bodyCompressed columns of stmt, nil if it was not stored.
+func readRequestBody(stmt *sqlite.Stmt, id int64) ([]byte, error) {
+	if stmt.ColumnType(stmt.ColumnIndex("body")) == sqlite.TypeNull {
+		return nil, nil
+	}
+	var body io.Reader = stmt.GetReader("body")
+	if stmt.GetBool("bodyCompressed") {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress body of request %d: %w", id, err)
+		}
+		body = zr
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress body of request %d: %w", id, err)
+	}
+	return b, nil
+}
+
+const selectUserDataStmt = `
+SELECT id, name, note,
+  IFNULL(expires_at, '') AS expiresAt,
+  IFNULL(deleted_at, '') AS deletedAt,
+  IFNULL(rate_limit_rpm, -1) AS rateLimitRPM,
+  IFNULL(rate_limit_tpm, -1) AS rateLimitTPM
+FROM users
+WHERE name = :userName`
+
+const listUserProjectsDataStmt = `
+SELECT projects.name AS projectName,
+  models.name AS modelName
+FROM projects
+LEFT JOIN project_models ON project_models.project_id = projects.id
+LEFT JOIN models ON models.id = project_models.model_id
+WHERE projects.user_id = :userID
+ORDER BY projectName, modelName`
+
+const listUserUsageStmt = `
+SELECT usage.ts AS ts,
+  projects.name AS projectName,
+  models.name AS modelName,
+  usage.tokens AS tokens,
+  IFNULL(usage.prompt_tokens, 0) AS promptTokens,
+  usage.cached_tokens AS cachedTokens,
+  usage.audio_seconds AS audioSeconds,
+  usage.requests AS requests,
+  usage.streamed AS streamed,
+  IFNULL(usage.tag, '') AS tag,
+  usage.test AS test
+FROM usage
+JOIN projects ON projects.id = usage.project_id
+JOIN models ON models.id = usage.model_id
+WHERE projects.user_id = :userID
+ORDER BY usage.ts, usage.rowid`
+
+const listUserRequestsStmt = `
+SELECT requests.id AS id,
+  requests.ts AS ts,
+  projects.name AS projectName,
+  models.name AS modelName,
+  requests.status AS status,
+  requests.body AS body,
+  requests.body_compressed AS bodyCompressed
+FROM requests
+JOIN projects ON projects.id = requests.project_id
+JOIN models ON models.id = requests.model_id
+WHERE projects.user_id = :userID
+ORDER BY requests.id`
+
+// userData is everything stored about a user, except the keys.
+type userData struct {
+	name string
+	note string
+	// Empty if the key does not expire
+	expiresAt string
+	// Empty unless the user is soft-deleted
+	deletedAt string
+	// Overrides of the default limits (0 = unlimited), -1 if none
+	rateLimitRPM int
+	rateLimitTPM int
+	projects     []userProject
+	usage        []userUsage
+	// Audit log, with the bodies if they were stored
+	requests []request
+}
+
+type userProject struct {
+	name string
+	// Models the project is restricted to, none if it may use any
+	models []string
+}
+
+// userUsage is a usage row, which sums several requests with
+// --usage-granularity hour or day.
+type userUsage struct {
+	ts          string
+	projectName string
+	modelName   string
+	tokens      int
+	// 0 if the split is not known
+	promptTokens int
+	cachedTokens int
+	audioSeconds int
+	requests     int
+	streamed     bool
+	tag          string
+	test         bool
+}
+
+// getUserData returns everything stored about the user, including a
+// soft-deleted one, and false if the user does not exist.
+func getUserData(conn *sqlite.Conn, userName string) (_ userData, _ bool, err error) {
+	// One read transaction, so that the parts are consistent
+	defer sqlitex.Save(conn)(&err)
+
+	var d userData
+	var userID int64
+	if err := sqlitex.ExecuteTransient(conn, selectUserDataStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{":userName": userName},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			userID = stmt.GetInt64("id")
+			d.name = stmt.GetText("name")
+			d.note = stmt.GetText("note")
+			d.expiresAt = stmt.GetText("expiresAt")
+			d.deletedAt = stmt.GetText("deletedAt")
+			d.rateLimitRPM = int(stmt.GetInt64("rateLimitRPM"))
+			d.rateLimitTPM = int(stmt.GetInt64("rateLimitTPM"))
+			return nil
+		},
+	}); err != nil {
+		return userData{}, false, fmt.Errorf("failed to select user: %w", err)
+	}
+	if userID == 0 {
+		return userData{}, false, nil
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, listUserProjectsDataStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{":userID": userID},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			name := stmt.GetText("projectName")
+			if len(d.projects) == 0 || d.projects[len(d.projects)-1].name != name {
+				d.projects = append(d.projects, userProject{name: name})
+			}
+			if model := stmt.GetText("modelName"); model != "" {
+				p := &d.projects[len(d.projects)-1]
+				p.models = append(p.models, model)
+			}
+			return nil
+		},
+	}); err != nil {
+		return userData{}, false, fmt.Errorf("failed to list projects: %w", err)
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, listUserUsageStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{":userID": userID},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			d.usage = append(d.usage, userUsage{
+				ts:           stmt.GetText("ts"),
+				projectName:  stmt.GetText("projectName"),
+				modelName:    stmt.GetText("modelName"),
+				tokens:       int(stmt.GetInt64("tokens")),
+				promptTokens: int(stmt.GetInt64("promptTokens")),
+				audioSeconds: int(stmt.GetInt64("audioSeconds")),
+				cachedTokens: int(stmt.GetInt64("cachedTokens")),
+				requests:     int(stmt.GetInt64("requests")),
+				streamed:     stmt.GetBool("streamed"),
+				tag:          stmt.GetText("tag"),
+				test:         stmt.GetBool("test"),
+			})
+			return nil
+		},
+	}); err != nil {
+		return userData{}, false, fmt.Errorf("failed to list usage: %w", err)
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, listUserRequestsStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{":userID": userID},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			req := request{
+				id:          stmt.GetInt64("id"),
+				ts:          stmt.GetText("ts"),
+				userName:    d.name,
+				projectName: stmt.GetText("projectName"),
+				modelName:   stmt.GetText("modelName"),
+				status:      int(stmt.GetInt64("status")),
+			}
+			var err error
+			if req.body, err = readRequestBody(stmt, req.id); err != nil {
+				return err
+			}
+			d.requests = append(d.requests, req)
+			return nil
+		},
+	}); err != nil {
+		return userData{}, false, fmt.Errorf("failed to list requests: %w", err)
+	}
+
+	return d, true, nil
+}
+
+const listUsersStmt = `
+SELECT name, key, note,
+  expires_at AS expiresAt,
+  expires_at <= CURRENT_TIMESTAMP AS expired
+FROM users
+WHERE deleted_at IS NULL
+ORDER BY name`
+
+type user struct {
+	name string
+	key  string
+	// Empty if the key does not expire
+	expiresAt string
+	expired   bool
+	// Free-text note for operators
+	note string
+}
+
+func listUsers(conn *sqlite.Conn) ([]user, error) {
+	var users []user
+
+	if err := sqlitex.ExecuteTransient(conn, listUsersStmt, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			var u user
+			u.name = stmt.GetText("name")
+			u.key = stmt.GetText("key")
+			u.expiresAt = stmt.GetText("expiresAt")
+			u.expired = stmt.GetBool("expired")
+			u.note = stmt.GetText("note")
+			users = append(users, u)
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	return users, nil
+}
+
+const setUserKeyQuery = `
+INSERT INTO users (name, key, expires_at)
+VALUES (:userName, :apiKey, NULLIF(:expiresAt, ''))
+ON CONFLICT (name) DO UPDATE SET key = :apiKey, expires_at = NULLIF(:expiresAt, '')`
+
+// setUserKey creates the user or replaces their key. expiresAt is a UTC
+// timestamp in keyExpiryFmt, an empty string means the key never expires.
+func setUserKey(conn *sqlite.Conn, userName string, apiKey string, expiresAt string) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	if err := sqlitex.ExecuteTransient(conn, setUserKeyQuery, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":userName":  userName,
+			":apiKey":    apiKey,
+			":expiresAt": expiresAt,
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to save user/key: %w", err)
+	}
+
+	return nil
+}
+
+const setUserNoteQuery = `UPDATE users SET note = :note WHERE name = :userName`
+
+func setUserNote(conn *sqlite.Conn, userName string, note string) (_ bool, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	if err := sqlitex.ExecuteTransient(conn, setUserNoteQuery, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":userName": userName,
+			":note":     note,
+		},
+	}); err != nil {
+		return false, fmt.Errorf("failed to set user note: %w", err)
+	}
+
+	return conn.Changes() != 0, nil
+}
+
+// NULL limits mean the user has no override and uses the defaults.
+const selectUserLimitsStmt = `SELECT
+  COALESCE(rate_limit_rpm, :defaultRPM) AS rpm,
+  COALESCE(rate_limit_tpm, :defaultTPM) AS tpm
+FROM users WHERE id = :userID`
+
+// getUserLimits returns the user's RPM and TPM limits, or the defaults if
+// the user has no override.
+func getUserLimits(conn *sqlite.Conn, userID int64, defaultRPM int, defaultTPM int) (rpm int, tpm int, err error) {
+	rpm, tpm = defaultRPM, defaultTPM
+	if err := sqlitex.ExecuteTransient(conn, selectUserLimitsStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":userID":     userID,
+			":defaultRPM": defaultRPM,
+			":defaultTPM": defaultTPM,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			rpm = int(stmt.GetInt64("rpm"))
+			tpm = int(stmt.GetInt64("tpm"))
+			return nil
+		},
+	}); err != nil {
+		return 0, 0, fmt.Errorf("failed to get user limits: %w", err)
+	}
+	return rpm, tpm, nil
+}
+
+const setUserLimitsStmt = `UPDATE users
+SET rate_limit_rpm = NULLIF(:rpm, -1), rate_limit_tpm = NULLIF(:tpm, -1)
+WHERE name = :userName`
+
+// setUserLimits overrides the default limits for the user. Limits of -1
+// remove the override.
+func setUserLimits(conn *sqlite.Conn, userName string, rpm int, tpm int) (_ bool, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	if err := sqlitex.ExecuteTransient(conn, setUserLimitsStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":userName": userName,
+			":rpm":      rpm,
+			":tpm":      tpm,
+		},
+	}); err != nil {
+		return false, fmt.Errorf("failed to set user limits: %w", err)
+	}
+
+	return conn.Changes() != 0, nil
+}
+
+// keyExpiryFmt matches SQLite's CURRENT_TIMESTAMP, so expiry can be
+// compared to it as text.
+const keyExpiryFmt = "2006-01-02 15:04:05"
+
+// parseKeyExpiry parses a key expiry given either as a duration from now
+// (720h), a date (YYYY-MM-DD, the key expires at its start) or a UTC
+// timestamp (YYYY-MM-DD HH:MM:SS) into keyExpiryFmt.
+func parseKeyExpiry(s string) (string, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return "", fmt.Errorf("expiry duration %s is not positive", d)
+		}
+		return time.Now().UTC().Add(d).Format(keyExpiryFmt), nil
+	}
+	for _, layout := range []string{"2006-01-02", keyExpiryFmt} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format(keyExpiryFmt), nil
+		}
+	}
+	return "", fmt.Errorf("invalid expiry %q, expected a duration, YYYY-MM-DD or YYYY-MM-DD HH:MM:SS", s)
+}
+
+const countUserProjectsByNameStmt = `
+SELECT COUNT(*) AS n
+FROM projects
+JOIN users ON users.id = projects.user_id
+WHERE users.name = :userName`
+
+// countUserProjects returns the number of projects (and hence potential
+// usage history) the user has.
+func countUserProjects(conn *sqlite.Conn, userName string) (int, error) {
+	var n int
+	if err := sqlitex.ExecuteTransient(conn, countUserProjectsByNameStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{":userName": userName},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			n = int(stmt.GetInt64("n"))
+			return nil
+		},
+	}); err != nil {
+		return 0, fmt.Errorf("failed to count user projects: %w", err)
+	}
+	return n, nil
+}
+
+const deleteUserProjectsQuery = `
+DELETE FROM usage WHERE project_id IN (SELECT projects.id FROM projects JOIN users ON users.id = projects.user_id WHERE users.name = :userName);
+DELETE FROM requests WHERE project_id IN (SELECT projects.id FROM projects JOIN users ON users.id = projects.user_id WHERE users.name = :userName);
+DELETE FROM idempotency_keys WHERE project_id IN (SELECT projects.id FROM projects JOIN users ON users.id = projects.user_id WHERE users.name = :userName);
+DELETE FROM project_models WHERE project_id IN (SELECT projects.id FROM projects JOIN users ON users.id = projects.user_id WHERE users.name = :userName);
+DELETE FROM projects WHERE user_id IN (SELECT id FROM users WHERE name = :userName);
+`
+
+const rotateUserKeyQuery = `
+UPDATE users
+SET prev_key = CASE WHEN :graceSeconds > 0 THEN key END,
+  prev_key_expires_at = CASE WHEN :graceSeconds > 0 THEN datetime('now', :graceSeconds || ' seconds') END,
+  key = :apiKey
+WHERE name = :userName`
+
+// rotateUserKey replaces the user's key with a new random one, starting
+// with keyPrefix, and returns it. The old key keeps working for the grace
+// period.
+func rotateUserKey(conn *sqlite.Conn, userName, keyPrefix string, grace time.Duration) (_ string, _ bool, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	apiKey, err := newAPIKey()
+	if err != nil {
+		return "", false, err
+	}
+	apiKey = keyPrefix + apiKey
+
+	if err := sqlitex.ExecuteTransient(conn, rotateUserKeyQuery, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":userName":     userName,
+			":apiKey":       apiKey,
+			":graceSeconds": int64(grace / time.Second),
+		},
+	}); err != nil {
+		return "", false, fmt.Errorf("failed to rotate user key: %w", err)
+	}
+
+	if conn.Changes() == 0 {
+		return "", false, nil
+	}
+	return apiKey, true, nil
+}
+
+func newAPIKey() (string, error) {
+	var b [24]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+const softDeleteUserQuery = `UPDATE users SET deleted_at = CURRENT_TIMESTAMP WHERE name = :userName AND deleted_at IS NULL`
+
+// softDeleteUser marks the user as deleted, keeping their projects and
+// usage history. Deleted users can't make requests and are not listed.
+func softDeleteUser(conn *sqlite.Conn, userName string) (_ bool, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	if err := sqlitex.ExecuteTransient(conn, softDeleteUserQuery, &sqlitex.ExecOptions{
+		Named: map[string]any{":userName": userName},
+	}); err != nil {
+		return false, fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	return conn.Changes() != 0, nil
+}
+
+const undeleteUserQuery = `UPDATE users SET deleted_at = NULL WHERE name = :userName AND deleted_at IS NOT NULL`
+
+// undeleteUser reverses softDeleteUser.
+func undeleteUser(conn *sqlite.Conn, userName string) (_ bool, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	if err := sqlitex.ExecuteTransient(conn, undeleteUserQuery, &sqlitex.ExecOptions{
+		Named: map[string]any{":userName": userName},
+	}); err != nil {
+		return false, fmt.Errorf("failed to undelete user: %w", err)
+	}
+
+	return conn.Changes() != 0, nil
+}
+
+const deleteUserQuery = `DELETE FROM users WHERE name = :userName`
+
+// deleteUser deletes the user permanently, soft-deleted or not. If cascade
+// is set, the user's projects and their usage history are deleted too,
+// otherwise deleting a user that has projects fails.
+func deleteUser(conn *sqlite.Conn, userName string, cascade bool) (_ bool, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	if cascade {
+		if err := sqlitex.ExecuteScript(conn, deleteUserProjectsQuery, &sqlitex.ExecOptions{
+			Named: map[string]any{":userName": userName},
+		}); err != nil {
+			return false, fmt.Errorf("failed to delete user projects: %w", err)
+		}
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, deleteUserQuery, &sqlitex.ExecOptions{
+		Named: map[string]any{":userName": userName},
+	}); err != nil {
+		return false, fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	return conn.Changes() != 0, nil
+}
+
+func findUserByName(conn *sqlite.Conn, userName string) (userID int64, found bool, _ error) {
+	if err := sqlitex.ExecuteTransient(conn, selectUserIDStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{":userName": userName},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			userID = stmt.GetInt64("id")
+			found = true
+			return nil
+		},
+	}); err != nil {
+		return 0, false, fmt.Errorf("failed to find user: %w", err)
+	}
+	return userID, found, nil
+}
+
+const findUserByKeyStmt = `
+SELECT id, name,
+  COALESCE(expires_at <= CURRENT_TIMESTAMP, 0) AS expired
+FROM users
+WHERE (key = :apiKey
+    OR (prev_key = :apiKey AND prev_key_expires_at > CURRENT_TIMESTAMP))
+  AND deleted_at IS NULL`
+
+// findUserByKey finds the user owning the key. Expired keys are still
+// found, so that they can be told apart from unknown ones.
+func findUserByKey(conn *sqlite.Conn, apiKey string) (_ int64, _ string, expired bool, found bool, _ error) {
+	var userID int64
+	var userName string
+	if err := sqlitex.ExecuteTransient(conn, findUserByKeyStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{":apiKey": apiKey},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			userID = stmt.GetInt64("id")
+			userName = stmt.GetText("name")
+			expired = stmt.GetBool("expired")
+			found = true
+			return nil
+		},
+	}); err != nil {
+		return 0, "", false, false, fmt.Errorf("failed to find user by key: %w", err)
+	}
+
+	return userID, userName, expired, found, nil
+}
+
+// With :weighted set, getUsageStmt reports cost units: prompt and
+// completion tokens multiplied by the model's multipliers, as in
+// weightedTokensExpr.
+//
+// Usage rows are summed per month, project and model before joining, so
+// that the joins and the final grouping only see the sums. This roughly
+// halves the time of full reports: about 2s for a million rows, against
+// 0.2s for a single month, which is read through the usage_ts index.
+const getUsageStmt = `
+SELECT u.month,
+  users.name AS userName,
+  projects.name || CASE WHEN :byModel THEN '/' || models.name ELSE '' END
+    || CASE WHEN :byTag AND u.tag IS NOT NULL THEN '#' || u.tag ELSE '' END AS projectName,
+  CAST(ROUND(SUM(CASE WHEN :weighted
+    THEN u.unsplit_tokens * models.multiplier
+      + u.prompt_tokens * IFNULL(models.prompt_multiplier, models.multiplier)
+      + (u.tokens - u.unsplit_tokens - u.prompt_tokens) * IFNULL(models.completion_multiplier, models.multiplier)
+      + u.audio_seconds * models.multiplier
+    ELSE u.tokens END)) AS INTEGER) AS usage,
+  SUM(u.requests) AS requests
+FROM (
+  SELECT strftime('%Y-%m', ts) AS month, project_id, model_id,
+    CASE WHEN :byTag THEN tag END AS tag,
+    SUM(tokens) AS tokens, SUM(requests) AS requests,
+    -- Tokens of rows without the prompt/completion split
+    SUM(CASE WHEN prompt_tokens IS NULL THEN tokens ELSE 0 END) AS unsplit_tokens,
+    SUM(IFNULL(prompt_tokens, 0)) AS prompt_tokens,
+    SUM(audio_seconds) AS audio_seconds
+  FROM usage
+  WHERE (:month = '' OR (ts >= :month || '-01' AND ts < date(:month || '-01', '+1 month')))
+    AND (:includeTest OR NOT test)
+  GROUP BY month, project_id, model_id, CASE WHEN :byTag THEN tag END
+) AS u
+JOIN projects ON projects.id = u.project_id
+JOIN users ON users.id = projects.user_id
+JOIN models ON models.id = u.model_id
+WHERE (:user = '' OR users.name = :user)
+  AND (:project = '' OR projects.name = :project)
+  AND (:projectLike = '' OR projects.name LIKE :projectLike ESCAPE '\')
+  AND (:model = '' OR models.name = :model)
+GROUP BY u.month, user_id, u.project_id, CASE WHEN :byModel THEN u.model_id END, u.tag
+ORDER BY u.month, usage DESC, user_id, u.project_id
+`
+
+// usageFilter restricts getUsage to the given user, project, model and
+// month (YYYY-MM). Empty fields do not restrict anything.
+type usageFilter struct {
+	user    string
+	project string
+	// LIKE pattern of project names, see globToLike
+	projectLike string
+	model       string
+	month       string
+	// Test traffic is left out unless includeTest is set
+	includeTest bool
+}
+
+// globToLike translates a glob (* matches any text, ? any character) to a
+// LIKE pattern with \ as the escape character. Like LIKE, the result
+// matches ASCII letters case-insensitively.
+func globToLike(glob string) string {
+	var b strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteByte('%')
+		case '?':
+			b.WriteByte('_')
+		case '%', '_', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// parseUsageFilter builds a usageFilter from key=value predicates.
+func parseUsageFilter(predicates map[string]string) (usageFilter, error) {
+	var f usageFilter
+	for k, v := range predicates {
+		switch k {
+		case "user":
+			f.user = v
+		case "project":
+			f.project = v
+		case "model":
+			f.model = v
+		case "month":
+			if _, err := time.Parse("2006-01", v); err != nil {
+				return usageFilter{}, fmt.Errorf("invalid month %q, expected YYYY-MM", v)
+			}
+			f.month = v
+		default:
+			return usageFilter{}, fmt.Errorf("unknown filter key %q, expected user, project, model or month", k)
+		}
+	}
+	return f, nil
+}
+
+type usage struct {
+	month    string
+	projects []projectUsage
+}
+
+type projectUsage struct {
+	userName    string
+	projectName string
+	tokens      int
+	// Number of requests that used the tokens
+	requests int
+}
+
+// getUsage returns monthly usage per project. With byModel, every model
+// used by a project is reported separately as "project/model". With
+// byTag, tagged usage is reported separately as "project#tag".
+func getUsage(conn *sqlite.Conn, weighted bool, byModel bool, byTag bool, filter usageFilter) ([]usage, error) {
+	var usages []usage
+
+	if err := sqlitex.ExecuteTransient(conn, getUsageStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":weighted":    weighted,
+			":byModel":     byModel,
+			":byTag":       byTag,
+			":user":        filter.user,
+			":project":     filter.project,
+			":projectLike": filter.projectLike,
+			":model":       filter.model,
+			":month":       filter.month,
+			":includeTest": filter.includeTest,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			month := stmt.GetText("month")
+			if len(usages) == 0 || usages[len(usages)-1].month != month {
+				usages = append(usages, usage{month: month})
+			}
+			u := &usages[len(usages)-1]
+			u.projects = append(u.projects, projectUsage{
+				userName:    stmt.GetText("userName"),
+				projectName: stmt.GetText("projectName"),
+				tokens:      int(stmt.GetInt64("usage")),
+				requests:    int(stmt.GetInt64("requests")),
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list usage: %w", err)
+	}
+
+	return usages, nil
+}
+
+// usageDiff is the usage of a project in two months, zero in the month
+// the project had no usage in.
+type usageDiff struct {
+	userName    string
+	projectName string
+	tokens      [2]int
+	units       [2]int
+}
+
+// getUsageDiff compares the usage of each project in monthA and monthB,
+// largest increases of tokens first. Test traffic is left out unless
+// includeTest is set.
+func getUsageDiff(conn *sqlite.Conn, monthA, monthB string, includeTest bool) ([]usageDiff, error) {
+	type projectKey struct{ userName, projectName string }
+	diffs := map[projectKey]*usageDiff{}
+	for i, month := range []string{monthA, monthB} {
+		for _, weighted := range []bool{false, true} {
+			usages, err := getUsage(conn, weighted, false, false, usageFilter{month: month, includeTest: includeTest})
+			if err != nil {
+				return nil, err
+			}
+			for _, u := range usages {
+				for _, pu := range u.projects {
+					key := projectKey{pu.userName, pu.projectName}
+					d := diffs[key]
+					if d == nil {
+						d = &usageDiff{userName: pu.userName, projectName: pu.projectName}
+						diffs[key] = d
+					}
+					if weighted {
+						d.units[i] = pu.tokens
+					} else {
+						d.tokens[i] = pu.tokens
+					}
+				}
+			}
+		}
+	}
+
+	res := make([]usageDiff, 0, len(diffs))
+	for _, d := range diffs {
+		res = append(res, *d)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		di, dj := res[i].tokens[1]-res[i].tokens[0], res[j].tokens[1]-res[j].tokens[0]
+		if di != dj {
+			return di > dj
+		}
+		if res[i].userName != res[j].userName {
+			return res[i].userName < res[j].userName
+		}
+		return res[i].projectName < res[j].projectName
+	})
+	return res, nil
+}
+
+const getProjectUsageStmt = `
+SELECT strftime('%Y-%m', usage.ts) AS month,
+  SUM(usage.tokens) AS tokens,
+  CAST(ROUND(SUM(` + weightedTokensExpr + `)) AS INTEGER) AS units
+FROM projects
+JOIN users ON users.id = projects.user_id
+LEFT JOIN usage ON usage.project_id = projects.id AND ` + usageTestCond + `
+LEFT JOIN models ON models.id = usage.model_id
+WHERE users.name = :userName AND projects.name = :projectName
+GROUP BY month
+ORDER BY month
+`
+
+type monthUsage struct {
+	month  string
+	tokens int
+	// Tokens multiplied by model multipliers
+	units int
+}
+
+// getProjectUsage returns the monthly usage of a single project in
+// chronological order. The project is found even if it has no usage yet.
+// Test traffic is left out unless includeTest is set.
+func getProjectUsage(conn *sqlite.Conn, userName, projectName string, includeTest bool) (_ []monthUsage, found bool, _ error) {
+	var usages []monthUsage
+	if err := sqlitex.ExecuteTransient(conn, getProjectUsageStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":userName":    userName,
+			":projectName": projectName,
+			":includeTest": includeTest,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			found = true
+			// A project without usage yields a single row of NULLs
+			if month := stmt.GetText("month"); month != "" {
+				usages = append(usages, monthUsage{
+					month:  month,
+					tokens: int(stmt.GetInt64("tokens")),
+					units:  int(stmt.GetInt64("units")),
+				})
+			}
+			return nil
+		},
+	}); err != nil {
+		return nil, false, fmt.Errorf("failed to get project usage: %w", err)
+	}
+	return usages, found, nil
+}
+
+// usageRangeCond restricts usage rows to the :from-:to date range
+// (inclusive, YYYY-MM-DD, an empty string means unbounded).
+const usageRangeCond = `(:from = '' OR usage.ts >= :from) AND (:to = '' OR usage.ts < date(:to, '+1 day'))`
+
+// usageTestCond leaves test traffic (X-Test) out of reports unless
+// :includeTest is set.
+const usageTestCond = `(:includeTest OR NOT usage.test)`
+
+const getRepeatedPromptsStmt = `
+SELECT usage.prompt_hash AS promptHash,
+  SUM(usage.requests) AS requests,
+  SUM(usage.tokens) AS tokens,
+  COUNT(DISTINCT usage.project_id) AS projects
+FROM usage
+WHERE usage.prompt_hash IS NOT NULL AND ` + usageRangeCond + ` AND ` + usageTestCond + `
+GROUP BY usage.prompt_hash
+HAVING SUM(usage.requests) > 1
+ORDER BY requests DESC, tokens DESC
+LIMIT :limit
+`
+
+type repeatedPrompt struct {
+	promptHash string
+	requests   int
+	tokens     int
+	// Number of projects that sent the prompt
+	projects int
+}
+
+// getRepeatedPrompts returns up to limit prompt hashes seen in more than
+// one request between from and to (inclusive, YYYY-MM-DD, empty means
+// unbounded), most repeated first. Test traffic is left out unless
+// includeTest is set.
+func getRepeatedPrompts(conn *sqlite.Conn, from, to string, limit int, includeTest bool) ([]repeatedPrompt, error) {
+	var prompts []repeatedPrompt
+
+	if err := sqlitex.ExecuteTransient(conn, getRepeatedPromptsStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":from":        from,
+			":to":          to,
+			":limit":       limit,
+			":includeTest": includeTest,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			prompts = append(prompts, repeatedPrompt{
+				promptHash: stmt.GetText("promptHash"),
+				requests:   int(stmt.GetInt64("requests")),
+				tokens:     int(stmt.GetInt64("tokens")),
+				projects:   int(stmt.GetInt64("projects")),
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get repeated prompts: %w", err)
+	}
+
+	return prompts, nil
+}
+
+// Only rows of a single request are considered, so with hour or day usage
+// granularity requests summed with others are missed.
+const getTopRequestsStmt = `
+SELECT usage.ts AS ts,
+  users.name AS userName,
+  projects.name AS projectName,
+  models.name AS modelName,
+  usage.tokens AS tokens
+FROM usage
+JOIN projects ON projects.id = usage.project_id
+JOIN users ON users.id = projects.user_id
+JOIN models ON models.id = usage.model_id
+WHERE usage.requests = 1 AND ` + usageRangeCond + ` AND ` + usageTestCond + `
+ORDER BY usage.tokens DESC, usage.ts
+LIMIT :limit
+`
+
+type topRequest struct {
+	ts          string
+	userName    string
+	projectName string
+	modelName   string
+	tokens      int
+}
+
+// getTopRequests returns up to limit requests made between from and to
+// (inclusive, YYYY-MM-DD, empty means unbounded) that used the most
+// tokens, largest first. Test traffic is left out unless includeTest is
+// set.
+func getTopRequests(conn *sqlite.Conn, from, to string, limit int, includeTest bool) ([]topRequest, error) {
+	var requests []topRequest
+
+	if err := sqlitex.ExecuteTransient(conn, getTopRequestsStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":from":        from,
+			":to":          to,
+			":limit":       limit,
+			":includeTest": includeTest,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			requests = append(requests, topRequest{
+				ts:          stmt.GetText("ts"),
+				userName:    stmt.GetText("userName"),
+				projectName: stmt.GetText("projectName"),
+				modelName:   stmt.GetText("modelName"),
+				tokens:      int(stmt.GetInt64("tokens")),
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get top requests: %w", err)
+	}
+
+	return requests, nil
+}
+
+const exportUsageStmt = `
+SELECT strftime('%Y-%m', usage.ts) AS month,
+  users.name AS userName,
+  projects.name AS projectName,
+  models.name AS modelName,
+  SUM(usage.tokens) AS usage,
+  SUM(usage.cached_tokens) AS cachedTokens,
+  SUM(usage.audio_seconds) AS audioSeconds
+FROM usage
+JOIN projects ON projects.id = usage.project_id
+JOIN users ON users.id = projects.user_id
+JOIN models ON models.id = usage.model_id
+WHERE ` + usageRangeCond + ` AND ` + usageTestCond + `
+GROUP BY month, user_id, project_id, model_id
+ORDER BY month, user_id, project_id, model_id
+`
+
+type modelUsage struct {
+	month       string
+	userName    string
+	projectName string
+	modelName   string
+	tokens      int
+	// Prompt tokens served from the prompt cache, included in tokens
+	cachedTokens int
+	// Seconds of audio of transcriptions billed by duration
+	audioSeconds int
+}
+
+// exportUsage calls fn for every (month, user, project, model) usage row
+// between from and to (inclusive, YYYY-MM-DD, empty means unbounded).
+// Test traffic is left out unless includeTest is set.
+func exportUsage(conn *sqlite.Conn, from, to string, includeTest bool, fn func(modelUsage) error) error {
+	if err := sqlitex.ExecuteTransient(conn, exportUsageStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":from":        from,
+			":to":          to,
+			":includeTest": includeTest,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			return fn(modelUsage{
+				month:        stmt.GetText("month"),
+				userName:     stmt.GetText("userName"),
+				projectName:  stmt.GetText("projectName"),
+				modelName:    stmt.GetText("modelName"),
+				tokens:       int(stmt.GetInt64("usage")),
+				cachedTokens: int(stmt.GetInt64("cachedTokens")),
+				audioSeconds: int(stmt.GetInt64("audioSeconds")),
+			})
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to export usage: %w", err)
+	}
+
+	return nil
+}
+
+const exportOpenAIUsageStmt = `
+SELECT CAST(strftime('%s', date(usage.ts)) AS INTEGER) AS day,
+  models.name AS modelName,
+  SUM(IFNULL(usage.prompt_tokens, 0)) AS contextTokens,
+  SUM(usage.tokens - IFNULL(usage.prompt_tokens, 0) - IFNULL(usage.floor_tokens, 0)) AS generatedTokens
+FROM usage
+JOIN models ON models.id = usage.model_id
+WHERE ` + usageRangeCond + ` AND NOT usage.passthrough
+GROUP BY day, model_id
+ORDER BY day, modelName
+`
+
+// openAIUsage is the usage of a model in a day, in the terms of OpenAI's
+// usage export.
+type openAIUsage struct {
+	// Start of the day (UTC)
+	day             time.Time
+	modelName       string
+	contextTokens   int
+	generatedTokens int
+}
+
+// exportOpenAIUsage calls fn for every (day, model) usage row between from
+// and to (inclusive, YYYY-MM-DD, empty means unbounded). Test traffic is
+// included, as upstream bills it too. Usage of passthrough keys, billed to
+// the clients' accounts, and tokens added by --min-tokens-per-request are
+// not.
+func exportOpenAIUsage(conn *sqlite.Conn, from, to string, fn func(openAIUsage) error) error {
+	if err := sqlitex.ExecuteTransient(conn, exportOpenAIUsageStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":from": from,
+			":to":   to,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			return fn(openAIUsage{
+				day:             time.Unix(stmt.GetInt64("day"), 0).UTC(),
+				modelName:       stmt.GetText("modelName"),
+				contextTokens:   int(stmt.GetInt64("contextTokens")),
+				generatedTokens: int(stmt.GetInt64("generatedTokens")),
+			})
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to export usage: %w", err)
+	}
+
+	return nil
+}
+
+const getModelTotalsStmt = `
+SELECT models.name AS modelName,
+  SUM(usage.tokens) AS tokens
+FROM usage
+JOIN models ON models.id = usage.model_id
+WHERE ` + usageRangeCond + ` AND ` + usageTestCond + `
+GROUP BY model_id
+ORDER BY tokens DESC, modelName
+`
+
+type modelTotal struct {
+	modelName string
+	tokens    int
+}
+
+// getModelTotals returns tokens used per model between from and to
+// (inclusive, YYYY-MM-DD, empty means unbounded), largest first. Test
+// traffic is left out unless includeTest is set.
+func getModelTotals(conn *sqlite.Conn, from, to string, includeTest bool) ([]modelTotal, error) {
+	var totals []modelTotal
+
+	if err := sqlitex.ExecuteTransient(conn, getModelTotalsStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":from":        from,
+			":to":          to,
+			":includeTest": includeTest,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			totals = append(totals, modelTotal{
+				modelName: stmt.GetText("modelName"),
+				tokens:    int(stmt.GetInt64("tokens")),
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get model totals: %w", err)
+	}
+
+	return totals, nil
+}
+
+const getInactiveUsersStmt = `
+SELECT users.name AS userName,
+  MAX(usage.ts) AS lastUsage
+FROM users
+LEFT JOIN projects ON projects.user_id = users.id
+LEFT JOIN usage ON usage.project_id = projects.id
+WHERE users.deleted_at IS NULL
+GROUP BY users.id
+HAVING MAX(usage.ts) IS NULL OR MAX(usage.ts) < :since
+ORDER BY lastUsage, userName
+`
+
+type inactiveUser struct {
+	name string
+	// Empty if the user never had any usage
+	lastUsage string
+}
+
+// getInactiveUsers returns the users without usage since the date since
+// (YYYY-MM-DD), least recently active first. Deleted users are left out.
+func getInactiveUsers(conn *sqlite.Conn, since string) ([]inactiveUser, error) {
+	var users []inactiveUser
+
+	if err := sqlitex.ExecuteTransient(conn, getInactiveUsersStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{":since": since},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			users = append(users, inactiveUser{
+				name:      stmt.GetText("userName"),
+				lastUsage: stmt.GetText("lastUsage"),
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get inactive users: %w", err)
+	}
+
+	return users, nil
+}
+
+const getTokenizerDivergenceStmt = `
+SELECT models.name AS modelName,
+  SUM(usage.reported_tokens) AS reportedTokens,
+  SUM(usage.estimated_tokens) AS estimatedTokens
+FROM usage
+JOIN models ON models.id = usage.model_id
+WHERE usage.estimated_tokens IS NOT NULL AND ` + usageRangeCond + ` AND ` + usageTestCond + `
+GROUP BY model_id
+ORDER BY modelName
+`
+
+type tokenizerDivergence struct {
+	modelName       string
+	reportedTokens  int
+	estimatedTokens int
+}
+
+// divergence returns how much the estimates deviate from the upstream
+// counts, as a fraction of the latter. Positive means overestimated.
+func (d tokenizerDivergence) divergence() float64 {
+	if d.reportedTokens == 0 {
+		return 0
+	}
+	return float64(d.estimatedTokens-d.reportedTokens) / float64(d.reportedTokens)
+}
+
+// getTokenizerDivergence returns, per model, the tokenizer estimates and
+// the upstream counts of requests with stored estimates between from and
+// to (inclusive, YYYY-MM-DD, empty means unbounded). Test traffic is left
+// out unless includeTest is set.
+func getTokenizerDivergence(conn *sqlite.Conn, from, to string, includeTest bool) ([]tokenizerDivergence, error) {
+	var divs []tokenizerDivergence
+
+	if err := sqlitex.ExecuteTransient(conn, getTokenizerDivergenceStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":from":        from,
+			":to":          to,
+			":includeTest": includeTest,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			divs = append(divs, tokenizerDivergence{
+				modelName:       stmt.GetText("modelName"),
+				reportedTokens:  int(stmt.GetInt64("reportedTokens")),
+				estimatedTokens: int(stmt.GetInt64("estimatedTokens")),
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get tokenizer divergence: %w", err)
+	}
+
+	return divs, nil
+}
+
+const getUserMonthUsageStmt = `
+SELECT users.name AS userName,
+  SUM(usage.tokens) AS tokens,
+  CAST(ROUND(SUM(` + weightedTokensExpr + `)) AS INTEGER) AS units
+FROM usage
+JOIN projects ON projects.id = usage.project_id
+JOIN users ON users.id = projects.user_id
+JOIN models ON models.id = usage.model_id
+WHERE usage.ts >= :month || '-01' AND usage.ts < date(:month || '-01', '+1 month')
+  AND ` + usageTestCond + `
+GROUP BY user_id
+ORDER BY units DESC, userName
+`
+
+type userTotal struct {
+	userName string
+	tokens   int
+	// Tokens multiplied by model multipliers
+	units int
+}
+
+// getUserMonthUsage returns the usage of every user in month (YYYY-MM),
+// largest first. Test traffic is left out unless includeTest is set.
+func getUserMonthUsage(conn *sqlite.Conn, month string, includeTest bool) ([]userTotal, error) {
+	var totals []userTotal
+
+	if err := sqlitex.ExecuteTransient(conn, getUserMonthUsageStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":month":       month,
+			":includeTest": includeTest,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			totals = append(totals, userTotal{
+				userName: stmt.GetText("userName"),
+				tokens:   int(stmt.GetInt64("tokens")),
+				units:    int(stmt.GetInt64("units")),
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get user usage: %w", err)
+	}
+
+	return totals, nil
+}
+
+const getStreamingUsageStmt = `
+SELECT strftime('%Y-%m', usage.ts) AS month,
+  SUM(CASE WHEN usage.streamed THEN usage.tokens ELSE 0 END) AS streamed,
+  SUM(CASE WHEN NOT usage.streamed THEN usage.tokens ELSE 0 END) AS plain,
+  SUM(CASE WHEN usage.streamed IS NULL THEN usage.tokens ELSE 0 END) AS unknown
+FROM usage
+WHERE ` + usageRangeCond + ` AND ` + usageTestCond + `
+GROUP BY month
+ORDER BY month
+`
+
+type streamingUsage struct {
+	month    string
+	streamed int
+	plain    int
+	// Usage recorded before streaming was tracked
+	unknown int
+}
+
+// getStreamingUsage returns monthly tokens of streamed and non-streamed
+// responses between from and to (inclusive, YYYY-MM-DD, empty means
+// unbounded). Test traffic is left out unless includeTest is set.
+func getStreamingUsage(conn *sqlite.Conn, from, to string, includeTest bool) ([]streamingUsage, error) {
+	var usages []streamingUsage
+
+	if err := sqlitex.ExecuteTransient(conn, getStreamingUsageStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":from":        from,
+			":to":          to,
+			":includeTest": includeTest,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			usages = append(usages, streamingUsage{
+				month:    stmt.GetText("month"),
+				streamed: int(stmt.GetInt64("streamed")),
+				plain:    int(stmt.GetInt64("plain")),
+				unknown:  int(stmt.GetInt64("unknown")),
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get streaming usage: %w", err)
+	}
+
+	return usages, nil
+}
+
+const getPeakUsageStmt = `
+WITH buckets AS (
+  SELECT CAST(strftime('%s', usage.ts) AS INTEGER) / :interval AS bucket,
+    SUM(usage.tokens) AS tokens
+  FROM usage
+  WHERE ` + usageRangeCond + ` AND ` + usageTestCond + `
+  GROUP BY bucket
+)
+SELECT COUNT(*) AS intervals,
+  COALESCE(MAX(tokens), 0) AS maxTokens,
+  COALESCE(AVG(tokens), 0) AS avgTokens,
+  COALESCE((SELECT bucket FROM buckets ORDER BY tokens DESC, bucket LIMIT 1), 0) * :interval AS peakStart
+FROM buckets
+`
+
+type peakUsage struct {
+	// number of intervals with any usage
+	intervals int
+	maxTokens int
+	// average over intervals with any usage
+	avgTokens float64
+	peakStart time.Time
+}
+
+// getPeakUsage buckets usage between from and to into intervals of the
+// given length (whole seconds) and reports the busiest and the average one.
+// Test traffic is left out unless includeTest is set.
+func getPeakUsage(conn *sqlite.Conn, from, to string, interval time.Duration, includeTest bool) (peakUsage, error) {
+	var pu peakUsage
+	if err := sqlitex.ExecuteTransient(conn, getPeakUsageStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":from":        from,
+			":to":          to,
+			":interval":    int64(interval / time.Second),
+			":includeTest": includeTest,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			pu.intervals = int(stmt.GetInt64("intervals"))
+			pu.maxTokens = int(stmt.GetInt64("maxTokens"))
+			pu.avgTokens = stmt.GetFloat("avgTokens")
+			pu.peakStart = time.Unix(stmt.GetInt64("peakStart"), 0).UTC()
+			return nil
+		},
+	}); err != nil {
+		return peakUsage{}, fmt.Errorf("failed to get peak usage: %w", err)
+	}
+	return pu, nil
+}
+
+const getErrorCountsStmt = `
+SELECT users.name AS userName,
+  projects.name AS projectName,
+  requests.status AS status,
+  COUNT(*) AS n
+FROM requests
+JOIN projects ON projects.id = requests.project_id
+JOIN users ON users.id = projects.user_id
+WHERE requests.status >= 400
+  AND (:from = '' OR requests.ts >= :from) AND (:to = '' OR requests.ts < date(:to, '+1 day'))
+GROUP BY user_id, project_id, status
+ORDER BY n DESC, user_id, project_id, status
+`
+
+type errorCount struct {
+	userName    string
+	projectName string
+	status      int
+	count       int
+}
+
+func getErrorCounts(conn *sqlite.Conn, from, to string) ([]errorCount, error) {
+	var counts []errorCount
+
+	if err := sqlitex.ExecuteTransient(conn, getErrorCountsStmt, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":from": from,
+			":to":   to,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			counts = append(counts, errorCount{
+				userName:    stmt.GetText("userName"),
+				projectName: stmt.GetText("projectName"),
+				status:      int(stmt.GetInt64("status")),
+				count:       int(stmt.GetInt64("n")),
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get error counts: %w", err)
+	}
+
+	return counts, nil
 }
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// newTestPool opens a migrated database in a temporary directory.
+func newTestPool(tb testing.TB) *sqlitemigration.Pool {
+	tb.Helper()
+	return newTestPoolAt(tb, filepath.Join(tb.TempDir(), "test.db"))
+}
+
+// newTestPoolAt opens a migrated database at path, closed when the test
+// ends.
+func newTestPoolAt(tb testing.TB, path string) *sqlitemigration.Pool {
+	tb.Helper()
+	pool, err := newPool(dbOptions{path: path})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+// getTestConn gets a connection of the pool, returned when the test ends.
+func getTestConn(tb testing.TB, pool *sqlitemigration.Pool) *sqlite.Conn {
+	tb.Helper()
+	conn, err := pool.Get(context.Background())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { pool.Put(conn) })
+	return conn
+}
+
+// testUsage creates a user with a project and returns a usage record of
+// the project.
+func testUsage(tb testing.TB, conn *sqlite.Conn, userName, key string) usageRecord {
+	tb.Helper()
+	if err := setUserKey(conn, userName, key, ""); err != nil {
+		tb.Fatal(err)
+	}
+	userID, _, err := findUserByName(conn, userName)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	projectID, err := getProjectID(conn, userID, "<default>", true, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	modelID, err := getModelID(conn, "gpt-4")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return usageRecord{modelID: modelID, projectID: projectID, tokens: 10, promptTokens: 7}
+}
+
+func TestForeignKeys(t *testing.T) {
+	conn := getTestConn(t, newTestPool(t))
+	u := testUsage(t, conn, "alice", "k1")
+
+	bogusProject := u
+	bogusProject.projectID = 1000
+	bogusModel := u
+	bogusModel.modelID = 1000
+
+	tests := []struct {
+		name string
+		f    func() error
+	}{
+		{"usage of a missing project", func() error { return saveUsage(conn, bogusProject, "") }},
+		{"usage of a missing model", func() error { return saveUsage(conn, bogusModel, "") }},
+		{"request of a missing project", func() error { return saveRequest(conn, u.modelID, 1000, 200, nil) }},
+		{"project of a missing user", func() error {
+			_, err := getProjectID(conn, 1000, "p", true, 0)
+			return err
+		}},
+		{"deleting a user with projects", func() error {
+			_, err := deleteUser(conn, "alice", false)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.f()
+			if sqlite.ErrCode(err) != sqlite.ResultConstraintForeignKey {
+				t.Errorf("got error %v, want a foreign key violation", err)
+			}
+		})
+	}
+
+	// The valid counterparts still work
+	if err := saveUsage(conn, u, ""); err != nil {
+		t.Errorf("saving valid usage: %v", err)
+	}
+	if _, err := deleteUser(conn, "alice", true); err != nil {
+		t.Errorf("deleting a user with cascade: %v", err)
+	}
+}
+
+func TestConcurrentBucketUsage(t *testing.T) {
+	const writers, writesPerWriter = 4, 25
+
+	pool := newTestPool(t)
+	u := testUsage(t, getTestConn(t, pool), "alice", "k1")
+
+	// Each writer has its own connection, so the writes contend for the
+	// database lock and for the same hourly bucket row
+	errs := make(chan error, writers*writesPerWriter)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		conn := getTestConn(t, pool)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < writesPerWriter; j++ {
+				if err := saveUsage(conn, u, "hour"); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("saveUsage: %v", err)
+	}
+
+	var rows, requests, tokens, promptTokens int
+	if err := sqlitex.ExecuteTransient(getTestConn(t, pool), "SELECT COUNT(*) AS rows, SUM(requests) AS requests, SUM(tokens) AS tokens, SUM(prompt_tokens) AS promptTokens FROM usage", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			rows, requests = int(stmt.GetInt64("rows")), int(stmt.GetInt64("requests"))
+			tokens, promptTokens = int(stmt.GetInt64("tokens")), int(stmt.GetInt64("promptTokens"))
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = writers * writesPerWriter
+	// A write at the turn of the hour may start another bucket
+	if rows < 1 || rows > 2 {
+		t.Errorf("got %d bucket rows, want 1 or 2", rows)
+	}
+	if requests != n || tokens != n*u.tokens || promptTokens != n*u.promptTokens {
+		t.Errorf("got %d requests, %d tokens, %d prompt tokens, want %d, %d, %d", requests, tokens, promptTokens, n, n*u.tokens, n*u.promptTokens)
+	}
+}
+
+// fillUsage saves n usage rows spread over the projects of users users,
+// models models and the last 12 months.
+func fillUsage(tb testing.TB, conn *sqlite.Conn, users, models, n int) {
+	tb.Helper()
+	var us []usageRecord
+	for i := 0; i < users; i++ {
+		u := testUsage(tb, conn, fmt.Sprintf("user%d", i), fmt.Sprintf("key%d", i))
+		for j := 0; j < 5; j++ {
+			projectID, err := getProjectID(conn, int64(i+1), fmt.Sprintf("project%d", j), true, 0)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			u.projectID = projectID
+			us = append(us, u)
+		}
+	}
+	var modelIDs []int64
+	for i := 0; i < models; i++ {
+		modelID, err := getModelID(conn, fmt.Sprintf("model%d", i))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		modelIDs = append(modelIDs, modelID)
+	}
+
+	err := func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+		for i := 0; i < n; i++ {
+			u := us[i%len(us)]
+			u.modelID = modelIDs[i%len(modelIDs)]
+			if err := saveUsageTx(conn, u, ""); err != nil {
+				return err
+			}
+		}
+		return sqlitex.ExecuteTransient(conn, "UPDATE usage SET ts = datetime(ts, -(rowid % 12) || ' months')", nil)
+	}()
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func BenchmarkGetUsage(b *testing.B) {
+	conn := getTestConn(b, newTestPool(b))
+	fillUsage(b, conn, 20, 4, 100000)
+
+	benchmarks := []struct {
+		name           string
+		weighted       bool
+		byModel, byTag bool
+		filter         usageFilter
+	}{
+		{name: "all"},
+		{name: "weighted", weighted: true},
+		{name: "by model", weighted: true, byModel: true},
+		{name: "by tag", byTag: true},
+		{name: "one user", weighted: true, filter: usageFilter{user: "user1"}},
+		{name: "one month", weighted: true, filter: usageFilter{month: time.Now().UTC().Format("2006-01")}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := getUsage(conn, bm.weighted, bm.byModel, bm.byTag, bm.filter); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReportsLeaveOutTestTraffic(t *testing.T) {
+	conn := getTestConn(t, newTestPool(t))
+	u := testUsage(t, conn, "alice", "k1")
+	u.promptHash, u.estimatedTokens, u.reportedTokens = "hash", 11, 10
+	test := u
+	test.test, test.tokens, test.estimatedTokens, test.reportedTokens = true, 100, 110, 100
+	for _, u := range []usageRecord{u, u, test, test} {
+		if err := saveUsage(conn, u, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	month := time.Now().UTC().Format("2006-01")
+
+	tests := []struct {
+		name string
+		// Tokens reported
+		tokens func(includeTest bool) (int, error)
+	}{
+		{"get-usage", func(includeTest bool) (int, error) {
+			usages, err := getUsage(conn, false, false, false, usageFilter{includeTest: includeTest})
+			n := 0
+			for _, u := range usages {
+				for _, pu := range u.projects {
+					n += pu.tokens
+				}
+			}
+			return n, err
+		}},
+		{"get-usage-diff", func(includeTest bool) (int, error) {
+			diffs, err := getUsageDiff(conn, month, month, includeTest)
+			n := 0
+			for _, d := range diffs {
+				n += d.tokens[1]
+			}
+			return n, err
+		}},
+		{"get-project-usage", func(includeTest bool) (int, error) {
+			usages, _, err := getProjectUsage(conn, "alice", "<default>", includeTest)
+			n := 0
+			for _, u := range usages {
+				n += u.tokens
+			}
+			return n, err
+		}},
+		{"get-projection", func(includeTest bool) (int, error) {
+			totals, err := getUserMonthUsage(conn, month, includeTest)
+			n := 0
+			for _, u := range totals {
+				n += u.tokens
+			}
+			return n, err
+		}},
+		{"export-usage", func(includeTest bool) (int, error) {
+			n := 0
+			err := exportUsage(conn, "", "", includeTest, func(u modelUsage) error {
+				n += u.tokens
+				return nil
+			})
+			return n, err
+		}},
+		{"get-model-totals", func(includeTest bool) (int, error) {
+			totals, err := getModelTotals(conn, "", "", includeTest)
+			n := 0
+			for _, mt := range totals {
+				n += mt.tokens
+			}
+			return n, err
+		}},
+		{"get-tokenizer-divergence", func(includeTest bool) (int, error) {
+			divs, err := getTokenizerDivergence(conn, "", "", includeTest)
+			n := 0
+			for _, d := range divs {
+				n += d.reportedTokens
+			}
+			return n, err
+		}},
+		{"get-streaming-usage", func(includeTest bool) (int, error) {
+			usages, err := getStreamingUsage(conn, "", "", includeTest)
+			n := 0
+			for _, u := range usages {
+				n += u.plain
+			}
+			return n, err
+		}},
+		{"get-top-requests", func(includeTest bool) (int, error) {
+			requests, err := getTopRequests(conn, "", "", 10, includeTest)
+			n := 0
+			for _, r := range requests {
+				n += r.tokens
+			}
+			return n, err
+		}},
+		{"get-repeated-prompts", func(includeTest bool) (int, error) {
+			prompts, err := getRepeatedPrompts(conn, "", "", 10, includeTest)
+			n := 0
+			for _, p := range prompts {
+				n += p.tokens
+			}
+			return n, err
+		}},
+		{"get-peak-usage", func(includeTest bool) (int, error) {
+			// A single interval holds all the usage
+			pu, err := getPeakUsage(conn, "", "", 200*365*24*time.Hour, includeTest)
+			return pu.maxTokens, err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, includeTest := range []bool{false, true} {
+				want := 2 * u.tokens
+				if includeTest {
+					want += 2 * test.tokens
+				}
+				got, err := tt.tokens(includeTest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("with includeTest %v got %d tokens, want %d", includeTest, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetUserMonthUsage(t *testing.T) {
+	conn := getTestConn(t, newTestPool(t))
+	u := testUsage(t, conn, "alice", "k1")
+	test := u
+	test.test = true
+	for _, r := range []struct {
+		u  usageRecord
+		ts string
+	}{
+		{u, "2026-01-31 23:59:59"},
+		{u, "2026-02-01 00:00:00"},
+		{u, "2026-02-28 23:59:59"},
+		{test, "2026-02-15 12:00:00"},
+		{u, "2026-03-01 00:00:00"},
+	} {
+		if err := saveUsage(conn, r.u, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := sqlitex.ExecuteTransient(conn, "UPDATE usage SET ts = :ts WHERE rowid = last_insert_rowid()", &sqlitex.ExecOptions{
+			Named: map[string]any{":ts": r.ts},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		includeTest bool
+		want        int
+	}{
+		{false, 20},
+		{true, 30},
+	} {
+		totals, err := getUserMonthUsage(conn, "2026-02", tt.includeTest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(totals) != 1 || totals[0].userName != "alice" || totals[0].tokens != tt.want {
+			t.Errorf("includeTest %v: got %+v, want %d tokens for alice", tt.includeTest, totals, tt.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// /v1/debug/route resolves the user, project and model of a chat
+// completion or Responses API request the way proxyRequest does and
+// reports them, so that clients can check their configuration. Nothing is
+// proxied, recorded or created, and rate limits do not apply.
+
+const debugRoutePath = "/v1/debug/route"
+
+type debugRoute struct {
+	Tenant string `json:"tenant"`
+	User   string `json:"user,omitempty"`
+	// Requests with the client's own upstream key
+	Passthrough bool   `json:"passthrough"`
+	Project     string `json:"project,omitempty"`
+	// Missing projects are created on first use unless autocreation is
+	// disabled
+	ProjectExists bool   `json:"project_exists"`
+	Model         string `json:"model,omitempty"`
+	ModelAllowed  bool   `json:"model_allowed"`
+}
+
+func (s *server) debugRoute(w http.ResponseWriter, r *http.Request) {
+	l := newReqLogger(r)
+
+	if r.Method != http.MethodPost {
+		l.Error("Unexpected method %q", r.Method)
+		httpError(w, "Only POST requests are supported", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	tenantName, pool, ok := s.tenantPool(r)
+	l.tenant = tenantName
+	if !ok {
+		l.Error("Unknown tenant %q", tenantName)
+		httpError(w, "Unknown tenant "+tenantName, http.StatusNotFound)
+		return
+	}
+	route := debugRoute{Tenant: tenantName}
+
+	trustedUser := s.trustedUser(r)
+	reqKey, keyFormat := parseAuthorization(r.Header.Get("Authorization"))
+	route.Passthrough = s.passthroughKey(trustedUser, reqKey)
+	if route.Passthrough && s.passthroughUser == "" {
+		// Proxied as is, so there is nothing else to resolve
+		s.writeDebugRoute(w, l, route)
+		return
+	}
+
+	conn, err := pool.Get(ctx)
+	if err != nil {
+		l.Error("Failed to get database connection: %v", err)
+		httpError(w, "database is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer pool.Put(conn)
+
+	userID, userName, _, ok := s.authenticate(w, l, conn, tenantName, trustedUser, reqKey, keyFormat, route.Passthrough)
+	if !ok {
+		return
+	}
+	l.userName, l.userID = userName, userID
+	route.User = userName
+
+	route.Project, ok = s.requestProjectName(w, l, r)
+	if !ok {
+		return
+	}
+	projectID, err := getProjectID(conn, userID, route.Project, false, 0)
+	if err != nil && !errors.Is(err, errProjectNotFound) {
+		l.Error("Failed to get project ID for project %q: %v", route.Project, err)
+		httpError(w, "failed to find project", http.StatusInternalServerError)
+		return
+	}
+	route.ProjectExists = err == nil
+
+	requestBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		l.Error("Failed to read request body: %v", err)
+		httpError(w, "failed to read request body", http.StatusInternalServerError)
+		return
+	}
+	crb, _, ok := parseRequestBody(w, l, r, requestBody)
+	if !ok {
+		return
+	}
+	route.Model = crb.Model
+
+	// New projects have no model allowlist
+	route.ModelAllowed = true
+	if route.ProjectExists {
+		modelID, err := findModelID(conn, crb.Model)
+		if err != nil {
+			l.Error("Failed to get model ID for model %q: %v", crb.Model, err)
+			httpError(w, "failed to get model "+crb.Model, http.StatusInternalServerError)
+			return
+		}
+		if route.ModelAllowed, err = projectModelAllowed(conn, projectID, modelID); err != nil {
+			l.Error("Failed to check project models: %v", err)
+			httpError(w, "failed to check project models", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	s.writeDebugRoute(w, l, route)
+}
+
+func (s *server) writeDebugRoute(w http.ResponseWriter, l *reqLogger, route debugRoute) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(route); err != nil {
+		l.Error("Failed to write route: %v", err)
+	}
+}
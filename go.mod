@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/ridge/must/v2 v2.0.0
 	github.com/spf13/pflag v1.0.5
+	github.com/tiktoken-go/tokenizer v0.1.0
 	zombiezen.com/go/sqlite v0.13.0
 )
 
@@ -14,7 +15,6 @@ require (
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/mattn/go-isatty v0.0.16 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
-	github.com/tiktoken-go/tokenizer v0.1.0 // indirect
 	golang.org/x/sys v0.0.0-20220811171246-fbc7d0a398ab // indirect
 	modernc.org/libc v1.22.3 // indirect
 	modernc.org/mathutil v1.5.0 // indirect
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const rateWindowDuration = time.Minute
+
+type rateWindow struct {
+	start    time.Time
+	requests int
+	tokens   int
+}
+
+// rateLimiter enforces requests-per-minute and tokens-per-minute limits for
+// arbitrary keys using fixed one-minute windows.
+//
+// Token usage is only known once a request is complete, so the TPM limit
+// rejects requests once the tokens already recorded in the current window
+// reach the limit.
+type rateLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{windows: map[string]*rateWindow{}}
+}
+
+func (l *rateLimiter) window(key string, now time.Time) *rateWindow {
+	w := l.windows[key]
+	if w == nil || now.Sub(w.start) >= rateWindowDuration {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+	return w
+}
+
+type rateLimit struct {
+	name string
+	// errorType is the OpenAI error type for exceeding this limit
+	errorType string
+}
+
+var (
+	requestsPerMinute = rateLimit{name: "requests per minute", errorType: "requests"}
+	tokensPerMinute   = rateLimit{name: "tokens per minute", errorType: "tokens"}
+)
+
+// allow counts a request against key and reports whether it fits in the
+// limits. 0 means no limit. If the request is rejected, the exceeded limit
+// is returned.
+func (l *rateLimiter) allow(key string, rpm, tpm int) (rateLimit, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w := l.window(key, time.Now())
+	if rpm != 0 && w.requests >= rpm {
+		return requestsPerMinute, false
+	}
+	if tpm != 0 && w.tokens >= tpm {
+		return tokensPerMinute, false
+	}
+	w.requests++
+	return rateLimit{}, true
+}
+
+// addTokens records tokens used by a request previously allowed for key.
+func (l *rateLimiter) addTokens(key string, tokens int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.window(key, time.Now()).tokens += tokens
+}
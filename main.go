@@ -1,30 +1,465 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
 )
 
 func cliUsage() {
-	fmt.Fprintf(os.Stderr, `Usage: gpt-proxy-split (serve|list-users|set-user-key|delete-user) <args>
+	fmt.Fprintf(os.Stderr, `Usage: gpt-proxy-split <command> <args>
 
-gpt-proxy-split serve <listenURL>
+gpt-proxy-split serve [--max-tokens-per-request N] [--max-prompt-tokens N]
+  [--force-max-tokens N] [--min-tokens-per-request N]
+  [--max-projects-per-user N] [--disable-project-autocreate]
+  [--max-project-name-length N] [--project-name-pattern regexp]
+  [--cors-origins origin,...]
+  [--admin-listen <adminListenURL> --admin-token <token>]
+  [--admin-path-prefix /prefix]
+  [--store-request-bodies [--max-stored-body-size N]]
+  [--tenant name=path ...] [--openai-key-file <path>]
+  [--upstream-url URL] [--upstream-path-prefix /v1]
+  [--upstream-auth-header name] [--upstream-auth-format format]
+  [--upstream-ca-file <path>] [--upstream-pin sha256//<base64> ...]
+  [--max-stream-duration 5m] [--sse-flush line|event]
+  [--forward-headers header,...]
+  [--upstream-retries N [--max-upstream-retries-backoff 10s]]
+  [--user-cache-size N [--user-cache-ttl 10s]] [--max-response-size N]
+  [--usage-granularity request|hour|day] [--idempotency-ttl 24h]
+  [--rate-limit-rpm N] [--rate-limit-tpm N]
+  [--log-file <path> [--log-max-size 100] [--log-max-backups 3]]
+  [--store-prompt-hashes] [--store-token-estimates] [--usage-stream]
+  [--trusted-header-auth header --trusted-proxies cidr,...]
+  [--key-prefix prefix]
+  [--passthrough-key-pattern regexp [--passthrough-user <user-name>]]
+  [--test-users name,...]
+  <listenURL>
+  The upstream key is read from OPENAI_KEY or, if given, --openai-key-file.
+  It may only be missing with --passthrough-key-pattern, in which case
+  requests with other keys fail with 503.
+  It is sent as the --upstream-auth-header header (Authorization by
+  default) with {key} in --upstream-auth-format ("Bearer {key}" by
+  default) replaced by it. For Azure OpenAI, use
+  --upstream-auth-header api-key --upstream-auth-format {key}.
+  Requests to /v1/... are sent to --upstream-url with /v1 replaced by
+  --upstream-path-prefix, e.g. /openai for gateways serving
+  /openai/chat/completions. It may be empty.
+  --upstream-ca-file trusts only the CA certificates in the PEM file for
+  upstream connections instead of the system ones. Each --upstream-pin
+  is the base64 SHA-256 of a public key (SubjectPublicKeyInfo), of
+  the upstream certificate or of a CA in its chain, e.g. from
+    openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der |
+      openssl dgst -sha256 -binary | base64
+  Connections to upstreams without a pinned key in their chain fail.
+  Both require an https --upstream-url and apply to sync-models too.
+  --force-max-tokens lowers max_completion_tokens (max_tokens if the
+  client uses it instead, max_output_tokens for /v1/responses) of
+  requests above N to N, and sets max_completion_tokens or
+  max_output_tokens for requests without a limit. Unlike
+  --max-tokens-per-request, such requests are not rejected.
+  --min-tokens-per-request records requests that used fewer than N tokens
+  as using N, so usage reports and rate limits no longer match the
+  upstream usage. The actual count is logged. Transcriptions and requests
+  that used no tokens are not affected.
+  Clients that can't set the X-Project header can send chat completions
+  to /v1/chat/completions/p/<project> instead, with the project name
+  URL-encoded.
+  Projects are created on first use unless --disable-project-autocreate
+  is given, then they have to be created with create-project. Requests
+  for other projects are rejected with the list of the user's projects.
+  X-Project values longer than --max-project-name-length bytes (100 by
+  default), with unprintable characters or not matching
+  --project-name-pattern, if given, are rejected.
+  Stored request bodies may contain sensitive data, so storing them is off
+  by default.
+  Each --tenant adds a tenant with its own database, selected by the
+  X-Tenant request header. Requests without the header use --db.
+  Streamed responses are flushed to the client after every line by
+  default. --sse-flush event flushes only at the end of each event, which
+  takes fewer writes for upstreams sending multi-line events.
+  Only the --forward-headers of client requests are sent upstream, by
+  default Content-Type, Accept, OpenAI-Organization, OpenAI-Project and
+  OpenAI-Beta.
+  Network failures, 429 and 5xx responses from upstream are retried
+  --upstream-retries times, none by default, with a random backoff that
+  doubles up to --max-upstream-retries-backoff.
+  --user-cache-size caches up to N key lookups in memory. Key changes made
+  through the admin API apply immediately, those made with CLI commands
+  may take up to --user-cache-ttl to apply.
+  --usage-granularity hour or day sums usage into one row per period,
+  project and model instead of storing a row per request. This keeps the
+  database small, but reports can't be finer than the period.
+  Requests time out after 60s, or earlier if the client sends an
+  X-Proxy-Timeout header with the number of seconds it is willing to wait.
+  Streamed chat completions and streamed /v1/responses requests with an
+  X-Proxy-Usage-Event: true header end with an extra "proxy_usage" event
+  (after [DONE] or response.completed), with the prompt_tokens,
+  completion_tokens and total_tokens the proxy counted, and whether they
+  are estimated by the tokenizer. Non-streamed responses ignore it.
+  Usage of requests with an X-Test: true header is recorded as test
+  traffic, which usage reports leave out unless --include-test is given.
+  Rate limits still count it. Only --test-users and requests from
+  --trusted-proxies may send X-Test: true, others are rejected with 403.
+  Clients retrying a request can send the same X-Idempotency-Key header.
+  The retry is proxied, but its usage is not saved if the project used
+  the key within --idempotency-ttl for the same model and body. Requests
+  reusing the key with a different model or body are rejected with 409.
+  Audio transcriptions (/v1/audio/transcriptions) are recorded in the
+  units the model is billed in: tokens, or seconds of audio for
+  duration-billed models such as whisper-1. Seconds are not counted as
+  tokens by reports and rate limits, only cost units include them, as
+  seconds × the model's multiplier. Transcriptions in text, srt or vtt
+  format carry no usage and are rejected with 400.
+  POST /v1/debug/route with the headers and body of a request reports the
+  user, project and model it would be billed to, without proxying it.
+  --rate-limit-rpm and --rate-limit-tpm limit requests and tokens per
+  minute of each user, unless overridden by set-user-rate-limit.
+  --store-prompt-hashes stores a SHA-256 of each prompt with its usage,
+  for get-repeated-prompts. Short prompts can be recovered from their
+  hashes by guessing, so this is off by default.
+  --store-token-estimates tokenizes the prompts and completions of
+  non-streamed requests and stores the count next to the upstream one,
+  for get-tokenizer-divergence. This takes extra CPU per request.
+  --usage-stream writes a JSON line to stdout for each request as its
+  usage is saved, with ts, request_id, tenant, user, project, model,
+  tokens, cached_tokens, audio_seconds, streamed, tag and test fields,
+  for piping into jq or a log collector. Requests wait for the line to be written, so
+  the reader has to keep up.
+  Behind a gateway that authenticates users itself, requests from
+  --trusted-proxies carrying the --trusted-header-auth header (e.g.
+  X-Authenticated-User) are made on behalf of the user it names, and
+  their keys are not checked. Requests from other addresses always need
+  a key, so make sure only the gateway is in --trusted-proxies.
+  Clients send their keys as Authorization: Bearer <key>, Token <key> or
+  just <key>.
+  With --key-prefix (e.g. pxk-), keys without the prefix are rejected
+  without a database lookup.
+  Keys matching --passthrough-key-pattern (e.g. ^sk-) are the clients' own
+  OpenAI keys, sent upstream instead of the proxy's. Their requests are
+  recorded under --passthrough-user, or, without it, proxied as they are:
+  no projects, limits or usage apply to them. This allows moving clients
+  to proxy keys gradually.
+  /healthz and /status are served on <listenURL>, the admin API on
+  --admin-listen as POST /admin/<method>. --admin-path-prefix moves them
+  under a prefix to match ingress conventions, e.g. /internal/healthz.
+  Logs go to stderr, or to --log-file. The log file is rotated when it
+  reaches --log-max-size megabytes, keeping --log-max-backups old files
+  as <path>.1, <path>.2 and so on.
 
 gpt-proxy-split list-users
 
-gpt-proxy-split set-user-key <user-name> <key>
+gpt-proxy-split set-user-key <user-name> <key> [<expiry>]
+  The key expires after <expiry>, given as a duration (720h), a date
+  (YYYY-MM-DD) or a UTC timestamp (YYYY-MM-DD HH:MM:SS). Without it the
+  key never expires.
 
-gpt-proxy-split delete-user <user-name>
+gpt-proxy-split set-user-note <user-name> <note>
+  Attaches a free-text note (owner, contact) shown by list-users. An
+  empty note removes it.
 
-gpt-proxy-split get-usage
+gpt-proxy-split set-user-rate-limit <user-name> (<rpm> <tpm>|default)
+  Overrides the serve --rate-limit-rpm and --rate-limit-tpm for the user
+  (0 = unlimited), or restores them with default. Applies to running
+  servers immediately.
+
+gpt-proxy-split rotate-user-key [--grace 10m] [--key-prefix prefix] <user-name>
+  Replaces the user's key with a new random one, starting with
+  --key-prefix if given, and prints it. The old key keeps working for the
+  grace period. The admin API uses the serve --key-prefix.
+
+gpt-proxy-split delete-user [--hard [--cascade [--force]]] <user-name>
+  Marks the user as deleted: their keys stop working and they are not
+  listed, but their projects and usage history are kept and still
+  reported. --hard deletes the user permanently, which fails if they
+  have projects unless --cascade is given. --cascade deletes the user's
+  projects and usage history too, after confirmation unless --force is
+  given.
+
+gpt-proxy-split undelete-user <user-name>
+  Restores a user deleted without --hard. set-user-key changes the key of
+  a deleted user, but does not restore them.
+
+gpt-proxy-split create-project <user-name> <project-name> [<model> ...]
+  Creates a project ahead of its first use, restricted to the given
+  models as by set-project-models.
+
+gpt-proxy-split set-project-models <user-name> <project-name> [<model> ...]
+  Restricts the project to the given models. Without models, the project
+  may use any model.
+
+gpt-proxy-split set-model-limit <model> <rpm> <tpm>
+
+gpt-proxy-split sync-models
+  Adds the models listed by the upstream /v1/models to the database. Uses
+  the same upstream key and --upstream-* options as serve.
+
+gpt-proxy-split set-model-multiplier <model> <multiplier>
+gpt-proxy-split set-model-multiplier <model> <prompt-multiplier> <completion-multiplier>
+  Sets the cost units per token of the model, 1 by default, either for all
+  tokens or separately for prompt and completion tokens. Usage recorded
+  before the split was tracked, and of transcriptions, is always weighted
+  by <multiplier>, so separate multipliers only apply to new usage.
+
+gpt-proxy-split get-usage [--weighted] [--group-models-into-projects]
+  [--group-by-tag] [--filter key=value ...] [--project-glob glob]
+  [--include-test]
+  With --weighted, reports cost units (tokens × model multipliers).
+  --filter restricts the report by user, project, model or month
+  (YYYY-MM), e.g. --filter user=alice,month=2024-05.
+  --project-glob restricts it to projects matching a glob, e.g. teamA/*
+  (* matches any text, ? a single character, letters match regardless of
+  case).
+  --group-models-into-projects reports each model of a project
+  separately, as project/model.
+  --group-by-tag reports usage of requests with an X-Usage-Tag header
+  separately for each tag, as project#tag.
+  Usage of requests with an X-Test: true header, such as load tests, is
+  left out of this and the other usage reports unless --include-test is
+  given.
+
+gpt-proxy-split get-usage-diff --month YYYY-MM --month YYYY-MM [--include-test]
+  Compares the tokens and cost units (tokens × model multipliers) of each
+  project in the two months, largest increases first.
+
+gpt-proxy-split get-project-usage <user-name> <project-name> [--include-test]
+  Reports tokens and cost units per month for a single project.
+
+gpt-proxy-split get-projection [--include-test]
+  Projects the usage of the current month (UTC) to its end, per user and
+  overall, assuming it continues at the rate of the month so far. Cost
+  units are tokens × model multipliers.
+
+gpt-proxy-split list-requests [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--limit N]
+
+gpt-proxy-split replay --target URL [--target-key key] [--rate 10]
+  [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--limit N]
+  Sends the stored bodies (serve --store-request-bodies) of the --limit
+  most recent requests to --target, oldest first, at --rate requests per
+  second, and reports the response statuses and latencies. Point it
+  at a proxy using a fake upstream, or at a fake upstream directly: real
+  requests cost money. Requests carry X-Test: true, their recorded
+  project as X-Project, and --target-key as the key, which has to belong
+  to one of the target's --test-users. Transcriptions are not replayed.
+
+gpt-proxy-split get-errors [--from YYYY-MM-DD] [--to YYYY-MM-DD]
+
+gpt-proxy-split get-model-totals [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--include-test]
+  Reports tokens per model, over all time unless limited.
+
+gpt-proxy-split get-inactive-users --since YYYY-MM-DD
+  Lists the users without usage since the date, with their last usage,
+  to find unused keys to delete.
+
+gpt-proxy-split get-tokenizer-divergence [--from YYYY-MM-DD] [--to YYYY-MM-DD]
+  [--include-test]
+  Compares the tokenizer estimates with the upstream token counts per
+  model. Only usage recorded with serve --store-token-estimates is
+  included. Large divergences suggest the tokenizer needs updating.
+
+gpt-proxy-split get-streaming-usage [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--include-test]
+  Reports tokens of streamed and non-streamed responses per month.
+
+gpt-proxy-split get-top-requests [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--limit N]
+  [--include-test]
+  Lists the single requests that used the most tokens. Usage recorded
+  with serve --usage-granularity hour or day is summed, so requests
+  sharing a period with others are not included.
+
+gpt-proxy-split get-repeated-prompts [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--limit N]
+  [--include-test]
+  Reports the prompts sent more than once, by hash, most repeated first.
+  Only usage recorded with serve --store-prompt-hashes is included.
+
+gpt-proxy-split get-peak-usage [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--interval 1m]
+  [--include-test]
+
+gpt-proxy-split export-usage [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--format csv|openai]
+  [--anonymize [--anonymize-salt salt]] [--include-test]
+  cached_tokens are the prompt tokens served from OpenAI's prompt cache,
+  included in tokens. audio_seconds are the seconds of audio of
+  transcriptions billed by duration, not included in tokens.
+  --format openai reports usage per day (UTC) and model in the columns of
+  OpenAI's usage export CSV: timestamp (Unix time of the day start),
+  model, n_context_tokens and n_generated_tokens, to diff the two. Test
+  traffic is always included, as upstream bills it too. Usage of --passthrough-user requests, billed to
+  the clients' own accounts, and tokens added by --min-tokens-per-request
+  are not, except in usage recorded before they were tracked. Usage
+  recorded before prompt tokens were tracked, and of transcriptions, is
+  reported as generated tokens.
+  --anonymize replaces user and project names with identifiers hashed
+  from them, the same in every export with the same --anonymize-salt.
+  Without a secret salt, names can be recovered by hashing guesses.
+
+gpt-proxy-split export-user-data <user-name>
+  Prints everything stored about the user as JSON, e.g. for a data
+  access request: the user's note, key expiry, rate limits and deletion,
+  projects, usage history and requests, with their bodies if stored.
+  Keys are not included. Deleted users are exported too, unless deleted with --hard.
+
+gpt-proxy-split diag [<serve options>]
+  Prints the schema version, row counts and model settings of --db, and
+  the options in effect, for bug reports. Keys, tokens and user data are
+  not included. Give it the same options as serve.
+
+gpt-proxy-split check-db
+  Runs SQLite integrity and foreign key checks on --db without migrating
+  it, exits with 1 if problems are found.
+
+gpt-proxy-split check-orphans [--repair]
+  Lists usage referencing projects or models that no longer exist, as
+  left by imports or manual edits with foreign keys disabled, and exits
+  with 1 if there is any. --repair reassigns it to the <orphaned> project
+  of the <orphaned> user and the <orphaned> model instead, so that it
+  shows up in reports. The user is created deleted.
+
+Global options:
+  [--db <path>]
+  Database file, gpt-proxy-split.db by default.
+  [--db-synchronous OFF|NORMAL|FULL|EXTRA]
+  SQLite synchronous mode, FULL by default. NORMAL is faster and cannot
+  corrupt the database, but may lose the last transactions on power loss.
+  [--report-db <path>]
+  Database file read by the get-*, list-requests, export-* and replay
+  commands and by the admin get-usage of the default tenant, so that
+  heavy reports don't slow down proxying. It is opened read-only and not
+  migrated, so it may be --db itself or a replica of it with an up to
+  date schema. Everything else uses --db.
 `)
 	os.Exit(2)
 }
 
+var (
+	dbFlag            = pflag.String("db", "gpt-proxy-split.db", "database file")
+	dbSynchronousFlag = pflag.String("db-synchronous", "", "SQLite synchronous mode (OFF, NORMAL, FULL, EXTRA)")
+	reportDBFlag      = pflag.String("report-db", "", "database file read by reports, opened read-only (default --db)")
+
+	fromFlag   = pflag.String("from", "", "start of the reported period, YYYY-MM-DD (inclusive)")
+	toFlag     = pflag.String("to", "", "end of the reported period, YYYY-MM-DD (inclusive)")
+	formatFlag = pflag.String("format", "csv", "export-usage: output format, csv or openai")
+
+	anonymizeFlag     = pflag.Bool("anonymize", false, "export-usage: replace user and project names with hashes")
+	anonymizeSaltFlag = pflag.String("anonymize-salt", "", "export-usage: secret mixed into --anonymize hashes")
+
+	graceFlag     = pflag.Duration("grace", 0, "rotate-user-key: how long the old key keeps working")
+	keyPrefixFlag = pflag.String("key-prefix", "", "prefix of keys issued by rotate-user-key, serve rejects keys without it")
+	hardFlag      = pflag.Bool("hard", false, "delete-user: delete the user permanently instead of marking them deleted")
+	cascadeFlag   = pflag.Bool("cascade", false, "delete-user --hard: also delete the user's projects and usage")
+	forceFlag     = pflag.Bool("force", false, "do not ask for confirmation")
+	repairFlag    = pflag.Bool("repair", false, "check-orphans: reassign orphaned usage to <orphaned>")
+
+	filterFlag      = pflag.StringToString("filter", nil, "get-usage: key=value predicates on user, project, model or month")
+	groupModelsFlag = pflag.Bool("group-models-into-projects", false, "get-usage: report project/model pairs as projects")
+	projectGlobFlag = pflag.String("project-glob", "", "get-usage: only report projects matching this glob, e.g. teamA/*")
+	groupByTagFlag  = pflag.Bool("group-by-tag", false, "get-usage: report usage tagged with X-Usage-Tag separately")
+	weightedFlag    = pflag.Bool("weighted", false, "get-usage: report tokens multiplied by model multipliers")
+	includeTestFlag = pflag.Bool("include-test", false, "usage reports: include usage of requests with the X-Test header")
+
+	limitFlag = pflag.Int("limit", 100, "maximum number of rows to print")
+
+	targetFlag    = pflag.String("target", "", "replay: base URL to send requests to, e.g. http://localhost:8080")
+	targetKeyFlag = pflag.String("target-key", "", "replay: key to send requests with")
+	rateFlag      = pflag.Float64("rate", 10, "replay: requests per second")
+
+	monthsFlag = pflag.StringArray("month", nil, "get-usage-diff: month to compare, YYYY-MM (given twice)")
+
+	sinceFlag = pflag.String("since", "", "get-inactive-users: list users without usage since this date, YYYY-MM-DD")
+
+	intervalFlag = pflag.Duration("interval", time.Minute, "bucket length for get-peak-usage")
+
+	maxTokensPerRequestFlag      = pflag.Int("max-tokens-per-request", 0, "reject requests with max_tokens above this value (0 = no limit)")
+	forceMaxTokensFlag           = pflag.Int("force-max-tokens", 0, "cap max_completion_tokens of proxied requests to this value, setting it if missing (0 = no cap)")
+	minTokensPerRequestFlag      = pflag.Int("min-tokens-per-request", 0, "record requests using fewer tokens as using this many (0 = no minimum)")
+	maxPromptTokensFlag          = pflag.Int("max-prompt-tokens", 0, "reject requests with prompts longer than this many tokens (0 = no limit)")
+	maxProjectsPerUserFlag       = pflag.Int("max-projects-per-user", 0, "do not auto-create projects beyond this many per user (0 = no limit)")
+	maxProjectNameLengthFlag     = pflag.Int("max-project-name-length", 100, "reject X-Project values longer than this many bytes")
+	projectNamePatternFlag       = pflag.String("project-name-pattern", "", "reject X-Project values not matching this regexp")
+	disableProjectAutocreateFlag = pflag.Bool("disable-project-autocreate", false, "reject requests for projects not created with create-project")
+	corsOriginsFlag              = pflag.StringSlice("cors-origins", nil, "origins allowed to call the proxy from browsers (* for any)")
+	adminListenFlag              = pflag.String("admin-listen", "", "address to serve the admin API on (disabled by default)")
+	adminPathPrefixFlag          = pflag.String("admin-path-prefix", "", "path prefix of /healthz, /status and /admin/, e.g. /internal")
+	adminTokenFlag               = pflag.String("admin-token", "", "bearer token required by the admin API")
+	storeRequestBodiesFlag       = pflag.Bool("store-request-bodies", false, "store request bodies for audit")
+	upstreamURLFlag              = pflag.String("upstream-url", openaiURL, "base URL of the upstream API")
+	upstreamPathPrefixFlag       = pflag.String("upstream-path-prefix", "/v1", "upstream path replacing /v1 in request paths")
+	upstreamAuthHeaderFlag       = pflag.String("upstream-auth-header", "Authorization", "header carrying the upstream key")
+	upstreamAuthFormatFlag       = pflag.String("upstream-auth-format", "Bearer {key}", "upstream auth header value, {key} is replaced by the key")
+	upstreamCAFileFlag           = pflag.String("upstream-ca-file", "", "PEM file of the CAs trusted for upstream connections (default system CAs)")
+	upstreamPinsFlag             = pflag.StringArray("upstream-pin", nil, "SHA-256 of a public key required in the upstream certificate chain, base64")
+	openaiKeyFileFlag            = pflag.String("openai-key-file", "", "file containing the upstream OpenAI key (overrides OPENAI_KEY)")
+	sseFlushFlag                 = pflag.String("sse-flush", "line", "flush streamed responses after every line or every event")
+	maxStreamDurationFlag        = pflag.Duration("max-stream-duration", 0, "cut off streamed responses after this long (0 = no limit)")
+	tenantsFlag                  = pflag.StringToString("tenant", nil, "tenant database, name=path (repeatable)")
+	forwardHeadersFlag           = pflag.StringSlice("forward-headers", []string{"Content-Type", "Accept", "OpenAI-Organization", "OpenAI-Project", "OpenAI-Beta"}, "client request headers forwarded upstream")
+	upstreamRetriesFlag          = pflag.Int("upstream-retries", 0, "retry failed upstream requests this many times")
+	maxRetriesBackoffFlag        = pflag.Duration("max-upstream-retries-backoff", 10*time.Second, "cap on the randomized delay between upstream retries")
+	userCacheSizeFlag            = pflag.Int("user-cache-size", 0, "cache this many user key lookups in memory (0 = no cache)")
+	userCacheTTLFlag             = pflag.Duration("user-cache-ttl", 10*time.Second, "how long cached user key lookups are used")
+	maxResponseSizeFlag          = pflag.Int("max-response-size", 16*1024*1024, "reject non-streamed upstream responses larger than this many bytes (0 = no limit)")
+	usageGranularityFlag         = pflag.String("usage-granularity", "request", "store usage per request, or summed per hour or day")
+	idempotencyTTLFlag           = pflag.Duration("idempotency-ttl", 24*time.Hour, "how long X-Idempotency-Key values are remembered")
+	maxStoredBodySizeFlag        = pflag.Int("max-stored-body-size", 64*1024, "truncate stored request bodies to this many bytes (0 = no limit)")
+	rateLimitRPMFlag             = pflag.Int("rate-limit-rpm", 0, "default requests per minute limit of each user (0 = no limit)")
+	rateLimitTPMFlag             = pflag.Int("rate-limit-tpm", 0, "default tokens per minute limit of each user (0 = no limit)")
+	storePromptHashesFlag        = pflag.Bool("store-prompt-hashes", false, "store hashes of prompts with usage")
+	storeTokenEstimatesFlag      = pflag.Bool("store-token-estimates", false, "store tokenizer estimates of non-streamed requests with usage")
+	usageStreamFlag              = pflag.Bool("usage-stream", false, "write saved usage to stdout as NDJSON")
+	trustedHeaderAuthFlag        = pflag.String("trusted-header-auth", "", "header naming the user in requests from --trusted-proxies")
+	trustedProxiesFlag           = pflag.StringSlice("trusted-proxies", nil, "addresses (CIDR or IP) allowed to use --trusted-header-auth")
+	passthroughKeyPatternFlag    = pflag.String("passthrough-key-pattern", "", "regexp of client keys sent upstream as they are, e.g. ^sk-")
+	passthroughUserFlag          = pflag.String("passthrough-user", "", "record usage of --passthrough-key-pattern keys under this user")
+	testUsersFlag                = pflag.StringSlice("test-users", nil, "users allowed to mark their requests as test traffic with X-Test")
+	logFileFlag                  = pflag.String("log-file", "", "write logs to this file instead of stderr")
+	logMaxSizeFlag               = pflag.Int("log-max-size", 100, "rotate the log file when it reaches this many megabytes")
+	logMaxBackupsFlag            = pflag.Int("log-max-backups", 3, "keep this many rotated log files")
+)
+
+func dbOptionsFromFlags() dbOptions {
+	return dbOptions{path: *dbFlag, synchronous: *dbSynchronousFlag}
+}
+
+// mustGetReportDB returns a connection for reporting commands and a
+// function closing it. With --report-db the connection is read-only and
+// the schema is not migrated.
+func mustGetReportDB() (*sqlite.Conn, func()) {
+	if *reportDBFlag == "" {
+		pool := mustNewPool(dbOptionsFromFlags())
+		db := mustGetDB(context.Background(), pool)
+		return db, func() {
+			pool.Put(db)
+			pool.Close()
+		}
+	}
+
+	db, err := sqlite.OpenConn(*reportDBFlag, sqlite.OpenReadOnly|sqlite.OpenURI)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open report database: %v\n", err)
+		os.Exit(1)
+	}
+	return db, func() { db.Close() }
+}
+
 func main() {
 	log.SetFlags(0)
 	pflag.Parse()
@@ -40,24 +475,325 @@ func main() {
 		listUsersCmd(pflag.Args()[1:])
 	case "set-user-key":
 		setUserKeyCmd(pflag.Args()[1:])
+	case "set-user-note":
+		setUserNoteCmd(pflag.Args()[1:])
+	case "set-user-rate-limit":
+		setUserRateLimitCmd(pflag.Args()[1:])
+	case "rotate-user-key":
+		rotateUserKeyCmd(pflag.Args()[1:])
 	case "delete-user":
 		deleteUserCmd(pflag.Args()[1:])
+	case "undelete-user":
+		undeleteUserCmd(pflag.Args()[1:])
+	case "create-project":
+		createProjectCmd(pflag.Args()[1:])
+	case "set-project-models":
+		setProjectModelsCmd(pflag.Args()[1:])
+	case "set-model-limit":
+		setModelLimitCmd(pflag.Args()[1:])
+	case "sync-models":
+		syncModelsCmd(pflag.Args()[1:])
+	case "set-model-multiplier":
+		setModelMultiplierCmd(pflag.Args()[1:])
 	case "get-usage":
 		getUsageCmd(pflag.Args()[1:])
+	case "get-usage-diff":
+		getUsageDiffCmd(pflag.Args()[1:])
+	case "get-project-usage":
+		getProjectUsageCmd(pflag.Args()[1:])
+	case "get-projection":
+		getProjectionCmd(pflag.Args()[1:])
+	case "list-requests":
+		listRequestsCmd(pflag.Args()[1:])
+	case "replay":
+		replayCmd(pflag.Args()[1:])
+	case "get-errors":
+		getErrorsCmd(pflag.Args()[1:])
+	case "get-model-totals":
+		getModelTotalsCmd(pflag.Args()[1:])
+	case "get-inactive-users":
+		getInactiveUsersCmd(pflag.Args()[1:])
+	case "get-tokenizer-divergence":
+		getTokenizerDivergenceCmd(pflag.Args()[1:])
+	case "get-streaming-usage":
+		getStreamingUsageCmd(pflag.Args()[1:])
+	case "get-top-requests":
+		getTopRequestsCmd(pflag.Args()[1:])
+	case "get-repeated-prompts":
+		getRepeatedPromptsCmd(pflag.Args()[1:])
+	case "get-peak-usage":
+		getPeakUsageCmd(pflag.Args()[1:])
+	case "export-usage":
+		exportUsageCmd(pflag.Args()[1:])
+	case "export-user-data":
+		exportUserDataCmd(pflag.Args()[1:])
+	case "diag":
+		diagCmd(pflag.Args()[1:])
+	case "check-db":
+		checkDBCmd(pflag.Args()[1:])
+	case "check-orphans":
+		checkOrphansCmd(pflag.Args()[1:])
 	default:
 		cliUsage()
 	}
 }
 
+// mustUpstreamPathPrefix returns --upstream-path-prefix without a trailing
+// slash.
+func mustUpstreamPathPrefix() string {
+	prefix := strings.TrimSuffix(*upstreamPathPrefixFlag, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		fmt.Fprintf(os.Stderr, "Invalid --upstream-path-prefix %q, expected a path starting with /\n", *upstreamPathPrefixFlag)
+		os.Exit(2)
+	}
+	return prefix
+}
+
+// mustAdminPathPrefix returns --admin-path-prefix without a trailing
+// slash.
+func mustAdminPathPrefix() string {
+	prefix := strings.TrimSuffix(*adminPathPrefixFlag, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		fmt.Fprintf(os.Stderr, "Invalid --admin-path-prefix %q, expected a path starting with /\n", *adminPathPrefixFlag)
+		os.Exit(2)
+	}
+	return prefix
+}
+
+// mustUpstreamTransport returns the transport of upstream requests set up
+// by --upstream-ca-file and --upstream-pin, nil for the default one.
+func mustUpstreamTransport() http.RoundTripper {
+	config, err := upstreamTLSConfig(*upstreamCAFileFlag, *upstreamPinsFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure upstream TLS: %v\n", err)
+		os.Exit(1)
+	}
+	if config != nil && !strings.HasPrefix(strings.ToLower(*upstreamURLFlag), "https://") {
+		fmt.Fprintf(os.Stderr, "--upstream-ca-file and --upstream-pin require an https --upstream-url\n")
+		os.Exit(2)
+	}
+	return upstreamTransport(config)
+}
+
+// mustReadOpenAIKey returns the upstream key from OPENAI_KEY or
+// --openai-key-file. If there is none, it exits unless optional is set.
+func mustReadOpenAIKey(optional bool) string {
+	openaiKey := os.Getenv("OPENAI_KEY")
+	if *openaiKeyFileFlag != "" {
+		key, err := os.ReadFile(*openaiKeyFileFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read OpenAI key: %v\n", err)
+			os.Exit(1)
+		}
+		openaiKey = strings.TrimSpace(string(key))
+	}
+	if openaiKey == "" && !optional {
+		fmt.Fprintf(os.Stderr, "No upstream OpenAI key configured, set OPENAI_KEY or use --openai-key-file\n")
+		os.Exit(1)
+	}
+	return openaiKey
+}
+
 func serveCmd(args []string) {
 	if len(args) != 1 {
 		cliUsage()
 	}
 
-	pool := mustNewPool()
+	// Passthrough keys are sent upstream themselves, so they can be served
+	// without a key of the proxy
+	openaiKey := mustReadOpenAIKey(*passthroughKeyPatternFlag != "")
+	if openaiKey == "" {
+		log.Printf("No upstream OpenAI key configured, only keys matching --passthrough-key-pattern can be used")
+	}
+
+	if *upstreamAuthHeaderFlag == "" || !strings.Contains(*upstreamAuthFormatFlag, "{key}") {
+		fmt.Fprintf(os.Stderr, "--upstream-auth-header must not be empty and --upstream-auth-format must contain {key}\n")
+		os.Exit(2)
+	}
+	var usageGranularity string
+	switch *usageGranularityFlag {
+	case "request":
+	case "hour", "day":
+		usageGranularity = *usageGranularityFlag
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid --usage-granularity %q, expected request, hour or day\n", *usageGranularityFlag)
+		os.Exit(2)
+	}
+	if *idempotencyTTLFlag < time.Second {
+		fmt.Fprintf(os.Stderr, "Invalid --idempotency-ttl %s\n", *idempotencyTTLFlag)
+		os.Exit(2)
+	}
+	if *rateLimitRPMFlag < 0 || *rateLimitTPMFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid --rate-limit-rpm %d or --rate-limit-tpm %d\n", *rateLimitRPMFlag, *rateLimitTPMFlag)
+		os.Exit(2)
+	}
+	if *userCacheSizeFlag < 0 || *userCacheTTLFlag <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid --user-cache-size %d or --user-cache-ttl %s\n", *userCacheSizeFlag, *userCacheTTLFlag)
+		os.Exit(2)
+	}
+	if *upstreamRetriesFlag < 0 || *maxRetriesBackoffFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid --upstream-retries %d or --max-upstream-retries-backoff %s\n", *upstreamRetriesFlag, *maxRetriesBackoffFlag)
+		os.Exit(2)
+	}
+
+	if *sseFlushFlag != "line" && *sseFlushFlag != "event" {
+		fmt.Fprintf(os.Stderr, "Invalid --sse-flush %q, expected line or event\n", *sseFlushFlag)
+		os.Exit(2)
+	}
+	if *forceMaxTokensFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid --force-max-tokens %d\n", *forceMaxTokensFlag)
+		os.Exit(2)
+	}
+	if *minTokensPerRequestFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid --min-tokens-per-request %d\n", *minTokensPerRequestFlag)
+		os.Exit(2)
+	}
+	if *maxProjectNameLengthFlag <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid --max-project-name-length %d\n", *maxProjectNameLengthFlag)
+		os.Exit(2)
+	}
+	var projectNamePattern *regexp.Regexp
+	if *projectNamePatternFlag != "" {
+		var err error
+		if projectNamePattern, err = regexp.Compile(*projectNamePatternFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --project-name-pattern: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	trustedProxies, err := parseTrustedProxies(*trustedProxiesFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --trusted-proxies: %v\n", err)
+		os.Exit(2)
+	}
+	if (*trustedHeaderAuthFlag == "") != (len(trustedProxies) == 0) {
+		fmt.Fprintf(os.Stderr, "--trusted-header-auth and --trusted-proxies must be given together\n")
+		os.Exit(2)
+	}
+	var passthroughKeyPattern *regexp.Regexp
+	if *passthroughKeyPatternFlag != "" {
+		if passthroughKeyPattern, err = regexp.Compile(*passthroughKeyPatternFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --passthrough-key-pattern: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if *passthroughUserFlag != "" && passthroughKeyPattern == nil {
+		fmt.Fprintf(os.Stderr, "--passthrough-user requires --passthrough-key-pattern\n")
+		os.Exit(2)
+	}
+	testUsers := map[string]bool{}
+	for _, name := range *testUsersFlag {
+		testUsers[name] = true
+	}
+	if *logMaxSizeFlag <= 0 || *logMaxBackupsFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid --log-max-size %d or --log-max-backups %d\n", *logMaxSizeFlag, *logMaxBackupsFlag)
+		os.Exit(2)
+	}
+	if *logFileFlag != "" {
+		logFile, err := openRotatingFile(*logFileFlag, int64(*logMaxSizeFlag)<<20, *logMaxBackupsFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open log file: %v\n", err)
+			os.Exit(1)
+		}
+		log.SetOutput(logFile)
+	}
+
+	pool := mustNewPool(dbOptionsFromFlags())
 	defer pool.Close()
 
-	serve(pool, args[0])
+	var reportPool *sqlitex.Pool
+	if *reportDBFlag != "" {
+		var err error
+		reportPool, err = newReportPool(*reportDBFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open report database: %v\n", err)
+			os.Exit(1)
+		}
+		defer reportPool.Close()
+	}
+
+	pools := map[string]*sqlitemigration.Pool{"": pool}
+	for name, path := range *tenantsFlag {
+		if name == "" {
+			fmt.Fprintf(os.Stderr, "Tenant name must not be empty\n")
+			os.Exit(2)
+		}
+		opts := dbOptionsFromFlags()
+		opts.path = path
+		tenantPool := mustNewPool(opts)
+		defer tenantPool.Close()
+		pools[name] = tenantPool
+	}
+
+	var usageStream io.Writer
+	if *usageStreamFlag {
+		usageStream = os.Stdout
+	}
+
+	serve(pools, args[0], serverConfig{
+		openaiKey:                 openaiKey,
+		reportPool:                reportPool,
+		usageStream:               usageStream,
+		upstreamURL:               strings.TrimSuffix(*upstreamURLFlag, "/"),
+		upstreamTransport:         mustUpstreamTransport(),
+		upstreamPathPrefix:        mustUpstreamPathPrefix(),
+		upstreamAuthHeader:        *upstreamAuthHeaderFlag,
+		upstreamAuthFormat:        *upstreamAuthFormatFlag,
+		maxTokensPerRequest:       *maxTokensPerRequestFlag,
+		maxPromptTokens:           *maxPromptTokensFlag,
+		forceMaxTokens:            *forceMaxTokensFlag,
+		minTokensPerRequest:       *minTokensPerRequestFlag,
+		maxProjectsPerUser:        *maxProjectsPerUserFlag,
+		maxProjectNameLength:      *maxProjectNameLengthFlag,
+		projectNamePattern:        projectNamePattern,
+		disableProjectAutocreate:  *disableProjectAutocreateFlag,
+		corsOrigins:               *corsOriginsFlag,
+		adminListenURL:            *adminListenFlag,
+		adminPathPrefix:           mustAdminPathPrefix(),
+		adminToken:                *adminTokenFlag,
+		storeRequestBodies:        *storeRequestBodiesFlag,
+		maxStoredBodySize:         *maxStoredBodySizeFlag,
+		maxStreamDuration:         *maxStreamDurationFlag,
+		flushPerEvent:             *sseFlushFlag == "event",
+		forwardHeaders:            *forwardHeadersFlag,
+		upstreamRetries:           *upstreamRetriesFlag,
+		maxUpstreamRetriesBackoff: *maxRetriesBackoffFlag,
+		userCacheSize:             *userCacheSizeFlag,
+		userCacheTTL:              *userCacheTTLFlag,
+		maxResponseSize:           *maxResponseSizeFlag,
+		usageGranularity:          usageGranularity,
+		idempotencyTTL:            *idempotencyTTLFlag,
+		storePromptHashes:         *storePromptHashesFlag,
+		storeTokenEstimates:       *storeTokenEstimatesFlag,
+		trustedAuthHeader:         *trustedHeaderAuthFlag,
+		trustedProxies:            trustedProxies,
+		rateLimitRPM:              *rateLimitRPMFlag,
+		rateLimitTPM:              *rateLimitTPMFlag,
+		keyPrefix:                 *keyPrefixFlag,
+		passthroughKeyPattern:     passthroughKeyPattern,
+		passthroughUser:           *passthroughUserFlag,
+		testUsers:                 testUsers,
+	})
+}
+
+// parseTrustedProxies parses CIDRs, or IPs standing for single addresses.
+func parseTrustedProxies(addrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
 }
 
 func listUsersCmd(args []string) {
@@ -65,7 +801,7 @@ func listUsersCmd(args []string) {
 		cliUsage()
 	}
 
-	pool := mustNewPool()
+	pool := mustNewPool(dbOptionsFromFlags())
 	defer pool.Close()
 
 	db := mustGetDB(context.Background(), pool)
@@ -78,22 +814,46 @@ func listUsersCmd(args []string) {
 	}
 
 	for _, user := range users {
-		fmt.Printf("%s\t%s\n", user.name, user.key)
+		var expiry string
+		switch {
+		case user.expired:
+			expiry = "expired " + user.expiresAt
+		case user.expiresAt != "":
+			expiry = "expires " + user.expiresAt
+		}
+
+		line := user.name + "\t" + user.key
+		if expiry != "" || user.note != "" {
+			line += "\t" + expiry
+		}
+		if user.note != "" {
+			line += "\t" + user.note
+		}
+		fmt.Println(line)
 	}
 }
 
 func setUserKeyCmd(args []string) {
-	if len(args) != 2 {
+	if len(args) != 2 && len(args) != 3 {
 		cliUsage()
 	}
 
-	pool := mustNewPool()
+	var expiresAt string
+	if len(args) == 3 {
+		var err error
+		if expiresAt, err = parseKeyExpiry(args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse expiry: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	pool := mustNewPool(dbOptionsFromFlags())
 	defer pool.Close()
 
 	db := mustGetDB(context.Background(), pool)
 	defer pool.Put(db)
 
-	if err := setUserKey(db, args[0], args[1]); err != nil {
+	if err := setUserKey(db, args[0], args[1], expiresAt); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to set user key: %v\n", err)
 		os.Exit(1)
 	}
@@ -101,18 +861,148 @@ func setUserKeyCmd(args []string) {
 	fmt.Printf("User %s is created/updated\n", args[0])
 }
 
+func setUserNoteCmd(args []string) {
+	if len(args) != 2 {
+		cliUsage()
+	}
+
+	pool := mustNewPool(dbOptionsFromFlags())
+	defer pool.Close()
+
+	db := mustGetDB(context.Background(), pool)
+	defer pool.Put(db)
+
+	found, err := setUserNote(db, args[0], args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set user note: %v\n", err)
+		os.Exit(1)
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "User %s is not found\n", args[0])
+		os.Exit(1)
+	}
+
+	fmt.Printf("User %s note is updated\n", args[0])
+}
+
+func setUserRateLimitCmd(args []string) {
+	rpm, tpm := -1, -1
+	switch {
+	case len(args) == 2 && args[1] == "default":
+	case len(args) == 3:
+		var err error
+		rpm, err = strconv.Atoi(args[1])
+		if err != nil || rpm < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid RPM limit %q\n", args[1])
+			os.Exit(2)
+		}
+		tpm, err = strconv.Atoi(args[2])
+		if err != nil || tpm < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid TPM limit %q\n", args[2])
+			os.Exit(2)
+		}
+	default:
+		cliUsage()
+	}
+
+	pool := mustNewPool(dbOptionsFromFlags())
+	defer pool.Close()
+
+	db := mustGetDB(context.Background(), pool)
+	defer pool.Put(db)
+
+	found, err := setUserLimits(db, args[0], rpm, tpm)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set user rate limit: %v\n", err)
+		os.Exit(1)
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "User %s is not found\n", args[0])
+		os.Exit(1)
+	}
+
+	if rpm == -1 {
+		fmt.Printf("User %s uses the default rate limits\n", args[0])
+	} else {
+		fmt.Printf("User %s is limited to %d RPM, %d TPM (0 = unlimited)\n", args[0], rpm, tpm)
+	}
+}
+
+func rotateUserKeyCmd(args []string) {
+	if len(args) != 1 {
+		cliUsage()
+	}
+	if *graceFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid --grace %s\n", *graceFlag)
+		os.Exit(2)
+	}
+
+	pool := mustNewPool(dbOptionsFromFlags())
+	defer pool.Close()
+
+	db := mustGetDB(context.Background(), pool)
+	defer pool.Put(db)
+
+	key, found, err := rotateUserKey(db, args[0], *keyPrefixFlag, *graceFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to rotate user key: %v\n", err)
+		os.Exit(1)
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "User %s is not found\n", args[0])
+		os.Exit(1)
+	}
+
+	fmt.Println(key)
+}
+
 func deleteUserCmd(args []string) {
 	if len(args) != 1 {
 		cliUsage()
 	}
+	if *cascadeFlag && !*hardFlag {
+		fmt.Fprintf(os.Stderr, "--cascade requires --hard\n")
+		os.Exit(2)
+	}
 
-	pool := mustNewPool()
+	pool := mustNewPool(dbOptionsFromFlags())
 	defer pool.Close()
 
 	db := mustGetDB(context.Background(), pool)
 	defer pool.Put(db)
 
-	deleted, err := deleteUser(db, args[0])
+	if !*hardFlag {
+		deleted, err := softDeleteUser(db, args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to delete user: %v\n", err)
+			os.Exit(1)
+		}
+		if deleted {
+			fmt.Fprintf(os.Stderr, "User %s is deleted, undelete-user restores them\n", args[0])
+		} else {
+			fmt.Fprintf(os.Stderr, "User %s is not found\n", args[0])
+		}
+		return
+	}
+
+	nProjects, err := countUserProjects(db, args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to delete user: %v\n", err)
+		os.Exit(1)
+	}
+
+	if nProjects != 0 {
+		if !*cascadeFlag {
+			fmt.Fprintf(os.Stderr, "User %s has %d project(s) with usage history, use --cascade to delete them too\n", args[0], nProjects)
+			os.Exit(1)
+		}
+		if !*forceFlag && !confirm(fmt.Sprintf("Delete user %s, %d project(s) and all their usage history?", args[0], nProjects)) {
+			fmt.Fprintf(os.Stderr, "User %s is not deleted\n", args[0])
+			os.Exit(1)
+		}
+	}
+
+	deleted, err := deleteUser(db, args[0], *cascadeFlag)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to delete user: %v\n", err)
 		os.Exit(1)
@@ -125,31 +1015,911 @@ func deleteUserCmd(args []string) {
 	}
 }
 
-// FIXME: split by model and calculate cost
+func undeleteUserCmd(args []string) {
+	if len(args) != 1 {
+		cliUsage()
+	}
+
+	pool := mustNewPool(dbOptionsFromFlags())
+	defer pool.Close()
+
+	db := mustGetDB(context.Background(), pool)
+	defer pool.Put(db)
+
+	undeleted, err := undeleteUser(db, args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to undelete user: %v\n", err)
+		os.Exit(1)
+	}
+
+	if undeleted {
+		fmt.Fprintf(os.Stderr, "User %s is restored\n", args[0])
+	} else {
+		fmt.Fprintf(os.Stderr, "User %s is not found or not deleted\n", args[0])
+	}
+}
+
+// confirm asks the question on stderr and reports whether the answer read
+// from stdin is yes.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
 
-func getUsageCmd(args []string) {
-	if len(args) != 0 {
+func setModelLimitCmd(args []string) {
+	if len(args) != 3 {
+		cliUsage()
+	}
+
+	rpm, err := strconv.Atoi(args[1])
+	if err != nil || rpm < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid RPM limit %q\n", args[1])
+		os.Exit(2)
+	}
+	tpm, err := strconv.Atoi(args[2])
+	if err != nil || tpm < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid TPM limit %q\n", args[2])
+		os.Exit(2)
+	}
+
+	pool := mustNewPool(dbOptionsFromFlags())
+	defer pool.Close()
+
+	db := mustGetDB(context.Background(), pool)
+	defer pool.Put(db)
+
+	if err := setModelLimits(db, args[0], rpm, tpm); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set model limit: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Model %s is limited to %d RPM, %d TPM (0 = unlimited)\n", args[0], rpm, tpm)
+}
+
+func createProjectCmd(args []string) {
+	if len(args) < 2 {
+		cliUsage()
+	}
+
+	pool := mustNewPool(dbOptionsFromFlags())
+	defer pool.Close()
+
+	db := mustGetDB(context.Background(), pool)
+	defer pool.Put(db)
+
+	err := createProject(db, args[0], args[1], args[2:])
+	switch {
+	case errors.Is(err, errUserNotFound):
+		fmt.Fprintf(os.Stderr, "User %s is not found\n", args[0])
+		os.Exit(1)
+	case errors.Is(err, errProjectExists):
+		fmt.Fprintf(os.Stderr, "Project %q of user %q already exists\n", args[1], args[0])
+		os.Exit(1)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Failed to create project: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Project %s of user %s is created\n", args[1], args[0])
+}
+
+func setProjectModelsCmd(args []string) {
+	if len(args) < 2 {
 		cliUsage()
 	}
 
-	pool := mustNewPool()
+	pool := mustNewPool(dbOptionsFromFlags())
 	defer pool.Close()
 
 	db := mustGetDB(context.Background(), pool)
 	defer pool.Put(db)
 
-	usage, err := getUsage(db)
+	found, err := setProjectModels(db, args[0], args[1], args[2:])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to get usage: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to set project models: %v\n", err)
+		os.Exit(1)
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "Project %q of user %q not found\n", args[1], args[0])
 		os.Exit(1)
 	}
 
-	fmt.Println("User            Project           Tokens")
-	fmt.Println("----------------------------------------")
-	for _, monthUsage := range usage {
-		fmt.Printf("%s\n----------------------------------------\n", monthUsage.month)
-		for _, user := range monthUsage.projects {
-			fmt.Printf("%-16s%-16s%8d\n", user.userName, user.projectName, user.tokens)
-		}
+	if len(args) == 2 {
+		fmt.Printf("Project %s of user %s may use any model\n", args[1], args[0])
+	} else {
+		fmt.Printf("Project %s of user %s may use %s\n", args[1], args[0], strings.Join(args[2:], ", "))
+	}
+}
+
+func syncModelsCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
 	}
+
+	openaiKey := mustReadOpenAIKey(false)
+
+	// The whole list is fetched before the database is touched
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*upstreamURLFlag, "/")+upstreamPath(mustUpstreamPathPrefix(), "/v1/models"), nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create models request: %v\n", err)
+		os.Exit(1)
+	}
+	req.Header.Set(*upstreamAuthHeaderFlag, strings.ReplaceAll(*upstreamAuthFormatFlag, "{key}", openaiKey))
+	resp, err := (&http.Client{Timeout: requestTimeout, Transport: mustUpstreamTransport()}).Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to fetch models: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		fmt.Fprintf(os.Stderr, "Failed to fetch models: %s: %s\n", resp.Status, bytes.TrimSpace(body))
+		os.Exit(1)
+	}
+	var models struct {
+		Data []struct {
+			ID string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&models); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse models: %v\n", err)
+		os.Exit(1)
+	}
+
+	var modelNames []string
+	for _, m := range models.Data {
+		if m.ID != "" {
+			modelNames = append(modelNames, m.ID)
+		}
+	}
+
+	pool := mustNewPool(dbOptionsFromFlags())
+	defer pool.Close()
+
+	db := mustGetDB(context.Background(), pool)
+	defer pool.Put(db)
+
+	added, err := addModels(db, modelNames)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to add models: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, m := range added {
+		fmt.Printf("Added model %s\n", m)
+	}
+	fmt.Printf("%d models upstream, %d new\n", len(modelNames), len(added))
+}
+
+func setModelMultiplierCmd(args []string) {
+	if len(args) != 2 && len(args) != 3 {
+		cliUsage()
+	}
+
+	var multipliers []float64
+	for _, arg := range args[1:] {
+		multiplier, err := strconv.ParseFloat(arg, 64)
+		if err != nil || multiplier < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid multiplier %q\n", arg)
+			os.Exit(2)
+		}
+		multipliers = append(multipliers, multiplier)
+	}
+
+	pool := mustNewPool(dbOptionsFromFlags())
+	defer pool.Close()
+
+	db := mustGetDB(context.Background(), pool)
+	defer pool.Put(db)
+
+	if len(multipliers) == 1 {
+		if err := setModelMultiplier(db, args[0], multipliers[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set model multiplier: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Model %s multiplier is set to %g\n", args[0], multipliers[0])
+		return
+	}
+
+	if err := setModelSplitMultipliers(db, args[0], multipliers[0], multipliers[1]); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set model multipliers: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Model %s multipliers are set to %g for prompt and %g for completion tokens\n", args[0], multipliers[0], multipliers[1])
+}
+
+// FIXME: calculate cost once models have prices
+
+func getUsageCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+	filter, err := parseUsageFilter(*filterFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --filter: %v\n", err)
+		os.Exit(2)
+	}
+	if *projectGlobFlag != "" {
+		filter.projectLike = globToLike(*projectGlobFlag)
+	}
+	filter.includeTest = *includeTestFlag
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	usage, err := getUsage(db, *weightedFlag, *groupModelsFlag, *groupByTagFlag, filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get usage: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *weightedFlag {
+		fmt.Println("User            Project            Units  Requests")
+	} else {
+		fmt.Println("User            Project           Tokens  Requests")
+	}
+	fmt.Println("--------------------------------------------------")
+	for _, monthUsage := range usage {
+		fmt.Printf("%s\n--------------------------------------------------\n", monthUsage.month)
+		for _, user := range monthUsage.projects {
+			fmt.Printf("%-16s%-16s%8d%10d\n", user.userName, user.projectName, user.tokens, user.requests)
+		}
+	}
+}
+
+func getUsageDiffCmd(args []string) {
+	if len(args) != 0 || len(*monthsFlag) != 2 {
+		cliUsage()
+	}
+	for _, month := range *monthsFlag {
+		if _, err := time.Parse("2006-01", month); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --month %q, expected YYYY-MM\n", month)
+			os.Exit(2)
+		}
+	}
+	monthA, monthB := (*monthsFlag)[0], (*monthsFlag)[1]
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	diffs, err := getUsageDiff(db, monthA, monthB, *includeTestFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get usage: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("User            Project         %10s%10s    Change   Units change\n", monthA, monthB)
+	fmt.Println("-----------------------------------------------------------------------------")
+	for _, d := range diffs {
+		fmt.Printf("%-16s%-16s%10d%10d%+10d%+15d\n", d.userName, d.projectName, d.tokens[0], d.tokens[1], d.tokens[1]-d.tokens[0], d.units[1]-d.units[0])
+	}
+}
+
+func getProjectUsageCmd(args []string) {
+	if len(args) != 2 {
+		cliUsage()
+	}
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	usage, found, err := getProjectUsage(db, args[0], args[1], *includeTestFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get project usage: %v\n", err)
+		os.Exit(1)
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "Project %q of user %q not found\n", args[1], args[0])
+		os.Exit(1)
+	}
+
+	fmt.Println("Month          Tokens      Units")
+	fmt.Println("--------------------------------")
+	for _, u := range usage {
+		fmt.Printf("%-8s%13d%11d\n", u.month, u.tokens, u.units)
+	}
+}
+
+func mustParseDateFlag(name, value string) {
+	if value == "" {
+		return
+	}
+	if _, err := time.Parse("2006-01-02", value); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --%s %q, expected YYYY-MM-DD\n", name, value)
+		os.Exit(2)
+	}
+}
+
+type exportedUser struct {
+	Name      string `json:"name"`
+	Note      string `json:"note,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	DeletedAt string `json:"deleted_at,omitempty"`
+	// Left out if the user has no override of the serve defaults
+	RateLimitRPM *int              `json:"rate_limit_rpm,omitempty"`
+	RateLimitTPM *int              `json:"rate_limit_tpm,omitempty"`
+	Projects     []exportedProject `json:"projects"`
+	Usage        []exportedUsage   `json:"usage"`
+	Requests     []exportedRequest `json:"requests"`
+}
+
+type exportedProject struct {
+	Name   string   `json:"name"`
+	Models []string `json:"models,omitempty"`
+}
+
+type exportedUsage struct {
+	TS           string `json:"ts"`
+	Project      string `json:"project"`
+	Model        string `json:"model"`
+	Tokens       int    `json:"tokens"`
+	PromptTokens int    `json:"prompt_tokens,omitempty"`
+	CachedTokens int    `json:"cached_tokens"`
+	AudioSeconds int    `json:"audio_seconds,omitempty"`
+	Requests     int    `json:"requests"`
+	Streamed     bool   `json:"streamed"`
+	Tag          string `json:"tag,omitempty"`
+	Test         bool   `json:"test,omitempty"`
+}
+
+type exportedRequest struct {
+	TS      string `json:"ts"`
+	Project string `json:"project"`
+	Model   string `json:"model"`
+	Status  int    `json:"status"`
+	// JSON bodies are included as they are, others as strings
+	Body any `json:"body,omitempty"`
+}
+
+func exportUserDataCmd(args []string) {
+	if len(args) != 1 {
+		cliUsage()
+	}
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	d, found, err := getUserData(db, args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get user data: %v\n", err)
+		os.Exit(1)
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "User %q not found\n", args[0])
+		os.Exit(1)
+	}
+
+	u := exportedUser{
+		Name:      d.name,
+		Note:      d.note,
+		ExpiresAt: d.expiresAt,
+		DeletedAt: d.deletedAt,
+		Projects:  []exportedProject{},
+		Usage:     []exportedUsage{},
+		Requests:  []exportedRequest{},
+	}
+	if d.rateLimitRPM != -1 {
+		u.RateLimitRPM = &d.rateLimitRPM
+	}
+	if d.rateLimitTPM != -1 {
+		u.RateLimitTPM = &d.rateLimitTPM
+	}
+	for _, p := range d.projects {
+		u.Projects = append(u.Projects, exportedProject{Name: p.name, Models: p.models})
+	}
+	for _, r := range d.usage {
+		u.Usage = append(u.Usage, exportedUsage{
+			TS:           r.ts,
+			Project:      r.projectName,
+			Model:        r.modelName,
+			Tokens:       r.tokens,
+			PromptTokens: r.promptTokens,
+			AudioSeconds: r.audioSeconds,
+			CachedTokens: r.cachedTokens,
+			Requests:     r.requests,
+			Streamed:     r.streamed,
+			Tag:          r.tag,
+			Test:         r.test,
+		})
+	}
+	for _, r := range d.requests {
+		req := exportedRequest{TS: r.ts, Project: r.projectName, Model: r.modelName, Status: r.status}
+		switch {
+		case r.body == nil:
+		case json.Valid(r.body):
+			req.Body = json.RawMessage(r.body)
+		default:
+			req.Body = string(r.body)
+		}
+		u.Requests = append(u.Requests, req)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(u); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write user data: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func exportUsageCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+	mustParseDateFlag("from", *fromFlag)
+	mustParseDateFlag("to", *toFlag)
+	if *formatFlag != "csv" && *formatFlag != "openai" {
+		fmt.Fprintf(os.Stderr, "Unsupported --format %q, expected csv or openai\n", *formatFlag)
+		os.Exit(2)
+	}
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	w := csv.NewWriter(os.Stdout)
+	check := func(err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to export usage: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *formatFlag == "openai" {
+		check(w.Write([]string{"timestamp", "model", "n_context_tokens", "n_generated_tokens"}))
+		check(exportOpenAIUsage(db, *fromFlag, *toFlag, func(u openAIUsage) error {
+			return w.Write([]string{strconv.FormatInt(u.day.Unix(), 10), u.modelName,
+				strconv.Itoa(u.contextTokens), strconv.Itoa(u.generatedTokens)})
+		}))
+		w.Flush()
+		check(w.Error())
+		return
+	}
+
+	check(w.Write([]string{"month", "user", "project", "model", "tokens", "cached_tokens", "audio_seconds"}))
+	check(exportUsage(db, *fromFlag, *toFlag, *includeTestFlag, func(u modelUsage) error {
+		if *anonymizeFlag {
+			// Project names are only unique per user
+			u.userName, u.projectName = anonymizeName("user", *anonymizeSaltFlag, u.userName),
+				anonymizeName("project", *anonymizeSaltFlag, u.userName+"\x00"+u.projectName)
+		}
+		return w.Write([]string{u.month, u.userName, u.projectName, u.modelName, strconv.Itoa(u.tokens), strconv.Itoa(u.cachedTokens),
+			strconv.Itoa(u.audioSeconds)})
+	}))
+	w.Flush()
+	check(w.Error())
+}
+
+// anonymizeName returns a stable identifier for the name, such as
+// user-1a2b3c4d5e6f.
+func anonymizeName(kind, salt, name string) string {
+	h := sha256.Sum256([]byte(salt + "\x00" + name))
+	return kind + "-" + hex.EncodeToString(h[:6])
+}
+
+func getPeakUsageCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+	mustParseDateFlag("from", *fromFlag)
+	mustParseDateFlag("to", *toFlag)
+	if *intervalFlag < time.Second || *intervalFlag%time.Second != 0 {
+		fmt.Fprintf(os.Stderr, "Invalid --interval %s, expected a whole number of seconds\n", *intervalFlag)
+		os.Exit(2)
+	}
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	pu, err := getPeakUsage(db, *fromFlag, *toFlag, *intervalFlag, *includeTestFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get peak usage: %v\n", err)
+		os.Exit(1)
+	}
+
+	if pu.intervals == 0 {
+		fmt.Println("No usage in the period")
+		return
+	}
+
+	perMinute := float64(time.Minute) / float64(*intervalFlag)
+	fmt.Printf("Intervals with usage: %d of %s\n", pu.intervals, *intervalFlag)
+	fmt.Printf("Peak: %d tokens (%.0f TPM) at %s\n", pu.maxTokens, float64(pu.maxTokens)*perMinute, pu.peakStart.Format("2006-01-02 15:04:05"))
+	fmt.Printf("Average: %.0f tokens (%.0f TPM)\n", pu.avgTokens, pu.avgTokens*perMinute)
+}
+
+func getErrorsCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+	mustParseDateFlag("from", *fromFlag)
+	mustParseDateFlag("to", *toFlag)
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	counts, err := getErrorCounts(db, *fromFlag, *toFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get error counts: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("User            Project         Status    Count")
+	fmt.Println("-----------------------------------------------")
+	for _, c := range counts {
+		fmt.Printf("%-16s%-16s%6d%9d\n", c.userName, c.projectName, c.status, c.count)
+	}
+}
+
+func getModelTotalsCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+	mustParseDateFlag("from", *fromFlag)
+	mustParseDateFlag("to", *toFlag)
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	totals, err := getModelTotals(db, *fromFlag, *toFlag, *includeTestFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get model totals: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Model                             Tokens")
+	fmt.Println("----------------------------------------")
+	for _, t := range totals {
+		fmt.Printf("%-28s%12d\n", t.modelName, t.tokens)
+	}
+}
+
+func getInactiveUsersCmd(args []string) {
+	if len(args) != 0 || *sinceFlag == "" {
+		cliUsage()
+	}
+	mustParseDateFlag("since", *sinceFlag)
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	users, err := getInactiveUsers(db, *sinceFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get inactive users: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("User            Last usage")
+	fmt.Println("-----------------------------------")
+	for _, u := range users {
+		lastUsage := u.lastUsage
+		if lastUsage == "" {
+			lastUsage = "never"
+		}
+		fmt.Printf("%-16s%s\n", u.name, lastUsage)
+	}
+}
+
+func getTokenizerDivergenceCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+	mustParseDateFlag("from", *fromFlag)
+	mustParseDateFlag("to", *toFlag)
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	divs, err := getTokenizerDivergence(db, *fromFlag, *toFlag, *includeTestFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get tokenizer divergence: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Model                             Reported     Estimated  Divergence")
+	fmt.Println("---------------------------------------------------------------------")
+	for _, d := range divs {
+		fmt.Printf("%-28s%14d%14d%+11.1f%%\n", d.modelName, d.reportedTokens, d.estimatedTokens, 100*d.divergence())
+	}
+}
+
+// extrapolateUsage linearly extrapolates usage during elapsed to period.
+func extrapolateUsage(usage int, elapsed, period time.Duration) int {
+	if elapsed <= 0 {
+		return usage
+	}
+	return int(math.Round(float64(usage) * float64(period) / float64(elapsed)))
+}
+
+func getProjectionCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	elapsed := now.Sub(monthStart)
+	month := monthStart.AddDate(0, 1, 0).Sub(monthStart)
+
+	totals, err := getUserMonthUsage(db, now.Format("2006-01"), *includeTestFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get usage: %v\n", err)
+		os.Exit(1)
+	}
+
+	var all userTotal
+	fmt.Printf("%s, projected from %.1f of %.0f days\n", now.Format("2006-01"), elapsed.Hours()/24, month.Hours()/24)
+	fmt.Println("User                  Tokens   Projected       Units   Projected")
+	fmt.Println("----------------------------------------------------------------")
+	for _, t := range totals {
+		fmt.Printf("%-16s%12d%12d%12d%12d\n", t.userName, t.tokens, extrapolateUsage(t.tokens, elapsed, month), t.units, extrapolateUsage(t.units, elapsed, month))
+		all.tokens += t.tokens
+		all.units += t.units
+	}
+	fmt.Println("----------------------------------------------------------------")
+	fmt.Printf("%-16s%12d%12d%12d%12d\n", "Total", all.tokens, extrapolateUsage(all.tokens, elapsed, month), all.units, extrapolateUsage(all.units, elapsed, month))
+}
+
+func getStreamingUsageCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+	mustParseDateFlag("from", *fromFlag)
+	mustParseDateFlag("to", *toFlag)
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	usages, err := getStreamingUsage(db, *fromFlag, *toFlag, *includeTestFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get streaming usage: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Month        Streamed       Plain  Streamed%     Unknown")
+	fmt.Println("--------------------------------------------------------")
+	for _, u := range usages {
+		share := 0.0
+		if known := u.streamed + u.plain; known != 0 {
+			share = 100 * float64(u.streamed) / float64(known)
+		}
+		fmt.Printf("%-8s%13d%12d%10.1f%%%12d\n", u.month, u.streamed, u.plain, share, u.unknown)
+	}
+}
+
+func getRepeatedPromptsCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+	mustParseDateFlag("from", *fromFlag)
+	mustParseDateFlag("to", *toFlag)
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	prompts, err := getRepeatedPrompts(db, *fromFlag, *toFlag, *limitFlag, *includeTestFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get repeated prompts: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Prompt hash        Requests      Tokens  Projects")
+	fmt.Println("-------------------------------------------------")
+	for _, p := range prompts {
+		// The hash prefix is enough to tell prompts apart here
+		fmt.Printf("%-16s%11d%12d%10d\n", p.promptHash[:16], p.requests, p.tokens, p.projects)
+	}
+}
+
+func getTopRequestsCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+	mustParseDateFlag("from", *fromFlag)
+	mustParseDateFlag("to", *toFlag)
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	requests, err := getTopRequests(db, *fromFlag, *toFlag, *limitFlag, *includeTestFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get top requests: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Time                User            Project         Model               Tokens")
+	fmt.Println("------------------------------------------------------------------------------")
+	for _, r := range requests {
+		fmt.Printf("%-20s%-16s%-16s%-16s%10d\n", r.ts, r.userName, r.projectName, r.modelName, r.tokens)
+	}
+}
+
+func listRequestsCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+	mustParseDateFlag("from", *fromFlag)
+	mustParseDateFlag("to", *toFlag)
+
+	db, closeDB := mustGetReportDB()
+	defer closeDB()
+
+	requests, err := listRequests(db, *fromFlag, *toFlag, *limitFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list requests: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, req := range requests {
+		fmt.Printf("%d\t%s\t%s\t%s\t%s\t%d\n", req.id, req.ts, req.userName, req.projectName, req.modelName, req.status)
+		if req.body != nil {
+			fmt.Printf("%s\n", req.body)
+		}
+	}
+}
+
+func replayCmd(args []string) {
+	if len(args) != 0 || *targetFlag == "" {
+		cliUsage()
+	}
+	mustParseDateFlag("from", *fromFlag)
+	mustParseDateFlag("to", *toFlag)
+	target, err := url.Parse(*targetFlag)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		fmt.Fprintf(os.Stderr, "Invalid --target %q, expected an http or https URL\n", *targetFlag)
+		os.Exit(2)
+	}
+	if !(*rateFlag > 0) {
+		fmt.Fprintf(os.Stderr, "Invalid --rate %v\n", *rateFlag)
+		os.Exit(2)
+	}
+
+	db, closeDB := mustGetReportDB()
+	requests, err := listRequests(db, *fromFlag, *toFlag, *limitFlag)
+	closeDB()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list requests: %v\n", err)
+		os.Exit(1)
+	}
+
+	var stored []request
+	for _, req := range requests {
+		if req.body != nil {
+			stored = append(stored, req)
+		}
+	}
+	if len(stored) == 0 {
+		fmt.Fprintf(os.Stderr, "No requests with stored bodies found\n")
+		os.Exit(1)
+	}
+
+	client := &http.Client{Timeout: requestTimeout}
+	replay(client, strings.TrimSuffix(*targetFlag, "/"), *targetKeyFlag, stored, *rateFlag).print(os.Stdout)
+}
+
+func checkDBCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+
+	// Opened directly, so that a damaged database is not migrated first
+	db, err := sqlite.OpenConn(*dbFlag, sqlite.OpenReadWrite)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	problems, err := checkDB(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to check database: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) != 0 {
+		os.Exit(1)
+	}
+	fmt.Println("Database is OK")
+}
+
+func checkOrphansCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+
+	pool := mustNewPool(dbOptionsFromFlags())
+	defer pool.Close()
+
+	db := mustGetDB(context.Background(), pool)
+	defer pool.Put(db)
+
+	orphans, err := findOrphanedUsage(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to find orphaned usage: %v\n", err)
+		os.Exit(1)
+	}
+	if len(orphans) == 0 {
+		fmt.Println("No orphaned usage")
+		return
+	}
+
+	for _, o := range orphans {
+		fmt.Printf("%d usage rows (%d tokens) reference missing %s ID=%d\n", o.rows, o.tokens, o.kind, o.id)
+	}
+
+	if !*repairFlag {
+		os.Exit(1)
+	}
+	n, err := repairOrphanedUsage(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to repair orphaned usage: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Reassigned %d references to %s\n", n, orphanedName)
+}
+
+// Options whose values are secret and left out of diag output
+var secretFlags = map[string]bool{
+	"admin-token":    true,
+	"target-key":     true,
+	"anonymize-salt": true,
+}
+
+func diagCmd(args []string) {
+	if len(args) != 0 {
+		cliUsage()
+	}
+
+	// Opened directly and read-only, so that the database is reported as
+	// is, not migrated first
+	db, err := sqlite.OpenConn(*dbFlag, sqlite.OpenReadOnly)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	d, err := getDiagnostics(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get diagnostics: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Schema version: %d (current %d)\n", d.schemaVersion, len(schema.Migrations))
+
+	fmt.Println("\nTables:")
+	for _, t := range d.tables {
+		fmt.Printf("  %-24s%10d rows\n", t.name, t.rows)
+	}
+
+	fmt.Println("\nModels:")
+	for _, m := range d.models {
+		if m.splitMultipliers {
+			fmt.Printf("  %-24s%8d RPM%10d TPM%8g/%g units/prompt/completion token\n", m.name, m.rpmLimit, m.tpmLimit, m.promptMultiplier, m.completionMultiplier)
+		} else {
+			fmt.Printf("  %-24s%8d RPM%10d TPM%8g units/token\n", m.name, m.rpmLimit, m.tpmLimit, m.multiplier)
+		}
+	}
+
+	fmt.Println("\nOptions:")
+	pflag.VisitAll(func(f *pflag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "<redacted>"
+		}
+		if f.Changed {
+			fmt.Printf("  --%s=%s\n", f.Name, value)
+		} else {
+			fmt.Printf("  --%s=%s (default)\n", f.Name, value)
+		}
+	})
+	fmt.Printf("  OPENAI_KEY set: %t\n", os.Getenv("OPENAI_KEY") != "")
 }
@@ -3,22 +3,39 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	mathrand "math/rand"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/ridge/must/v2"
 	"github.com/tiktoken-go/tokenizer"
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
 )
 
+// openaiURL is the default upstream.
 const openaiURL = "https://api.openai.com"
 
 type completionRequestBody struct {
@@ -26,26 +43,177 @@ type completionRequestBody struct {
 	Messages []struct {
 		Content string
 	}
-	Suffix string
-	Stream bool
+	Suffix    string
+	Stream    bool
+	MaxTokens int `json:"max_tokens"`
+	// Replaces max_tokens for newer models
+	MaxCompletionTokens int `json:"max_completion_tokens"`
+
+	// Responses API fields
+	Instructions    string
+	Input           responsesInput
+	MaxOutputTokens int `json:"max_output_tokens"`
+}
+
+// maxTokens returns the requested completion size limit, whichever API
+// the request is for.
+func (crb completionRequestBody) maxTokens() int {
+	n := crb.MaxTokens
+	if crb.MaxCompletionTokens > n {
+		n = crb.MaxCompletionTokens
+	}
+	if crb.MaxOutputTokens > n {
+		n = crb.MaxOutputTokens
+	}
+	return n
+}
+
+// capMaxTokens limits the completion size field of a JSON request body to
+// limit, adding the field if it is missing or null. Other fields are kept
+// as they are. It returns the previous value, 0 if there was none, and
+// whether the body was changed.
+func capMaxTokens(body []byte, field string, limit int) (_ []byte, prev int, capped bool, _ error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, 0, false, fmt.Errorf("failed to parse request body: %w", err)
+	}
+	if raw, ok := fields[field]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &prev); err != nil {
+			return nil, 0, false, fmt.Errorf("invalid %s: %w", field, err)
+		}
+		if prev <= limit {
+			return body, prev, false, nil
+		}
+	}
+	fields[field] = json.RawMessage(strconv.Itoa(limit))
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("failed to encode request body: %w", err)
+	}
+	return body, prev, true, nil
+}
+
+// responseUsage is the usage object of both chat completions and Responses
+// API responses.
+type responseUsage struct {
+	TotalTokens         int `json:"total_tokens"`
+	PromptTokens        int `json:"prompt_tokens"`
+	InputTokens         int `json:"input_tokens"`
+	OutputTokens        int `json:"output_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	InputTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+}
+
+// cachedTokens returns the prompt tokens served from OpenAI's prompt
+// cache, which are billed at a discount.
+func (u responseUsage) cachedTokens() int {
+	if u.PromptTokensDetails.CachedTokens != 0 {
+		return u.PromptTokensDetails.CachedTokens
+	}
+	return u.InputTokensDetails.CachedTokens
+}
+
+// usage returns the requestUsage reported by upstream.
+func (u responseUsage) usage() requestUsage {
+	return requestUsage{tokens: u.tokens(), promptTokens: u.promptTokens(), cachedTokens: u.cachedTokens()}
+}
+
+// requestUsage is the usage of a proxied request, as determined by the
+// response handlers.
+type requestUsage struct {
+	tokens int
+	// Prompt tokens, included in tokens
+	promptTokens int
+	// Prompt tokens served from the prompt cache, included in tokens
+	cachedTokens int
+	// Tokenizer estimate of tokens, 0 if not estimated
+	estimatedTokens int
+	// Seconds of audio of transcriptions billed by duration, not tokens
+	audioSeconds int
+}
+
+func (u responseUsage) promptTokens() int {
+	if u.PromptTokens != 0 {
+		return u.PromptTokens
+	}
+	return u.InputTokens
+}
+
+func (u responseUsage) tokens() int {
+	if u.TotalTokens != 0 {
+		return u.TotalTokens
+	}
+	return u.InputTokens + u.OutputTokens
 }
 
 type completionResponseBody struct {
-	Usage struct {
-		TotalTokens int `json:"total_tokens"`
+	Usage responseUsage
+	// Chat completions
+	Choices []struct {
+		Message struct {
+			Content   string
+			ToolCalls []struct {
+				Function struct {
+					Name      string
+					Arguments string
+				}
+			} `json:"tool_calls"`
+		}
+	}
+	// Responses API
+	Output []struct {
+		Content []struct {
+			Text string
+		}
 	}
 }
 
+// completionText returns the generated text of the response.
+func (b completionResponseBody) completionText() string {
+	var texts []string
+	for _, choice := range b.Choices {
+		texts = append(texts, choice.Message.Content)
+		for _, call := range choice.Message.ToolCalls {
+			texts = append(texts, call.Function.Name, call.Function.Arguments)
+		}
+	}
+	for _, item := range b.Output {
+		for _, part := range item.Content {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "")
+}
+
 type completionResponseStreamedBody struct {
+	// Only sent in the last chunk, without choices, if the client asked
+	// for it with stream_options.include_usage
+	Usage   *responseUsage
 	Choices []struct {
 		Delta struct {
 			Content string
+			// Tool calls are generated too, in pieces of the name and
+			// the JSON arguments
+			ToolCalls []struct {
+				Function struct {
+					Name      string
+					Arguments string
+				}
+			} `json:"tool_calls"`
 		}
 	}
 }
 
 const timeFmt = `2006-01-02 15:04:05.000`
 
+// requestTimeout caps the time spent on a single proxied request.
+// Graceful shutdown waits this long for in-flight requests to finish.
+const requestTimeout = 60 * time.Second
+
 func reqPrint(r *http.Request, prefix string, fmt string, args ...any) {
 	log.Printf(prefix+"%s %21s "+fmt, append([]any{
 		time.Now().UTC().Format(timeFmt),
@@ -61,6 +229,97 @@ func logError(r *http.Request, fmt string, args ...any) {
 	reqPrint(r, "ERR ", fmt, args...)
 }
 
+// reqLogger logs messages about a proxied request, prefixed with the
+// request ID and the tenant, user, project and model as soon as they are
+// resolved.
+type reqLogger struct {
+	r           *http.Request
+	requestID   string
+	tenant      string
+	userName    string
+	userID      int64
+	projectName string
+	projectID   int64
+	model       string
+	modelID     int64
+}
+
+func newReqLogger(r *http.Request) *reqLogger {
+	var id [4]byte
+	_, _ = rand.Read(id[:])
+	return &reqLogger{r: r, requestID: hex.EncodeToString(id[:])}
+}
+
+func (l *reqLogger) fields() string {
+	f := "[req " + l.requestID
+	if l.tenant != "" {
+		f += fmt.Sprintf(", tenant %q", l.tenant)
+	}
+	if l.userName != "" {
+		f += fmt.Sprintf(", user %q (ID=%d)", l.userName, l.userID)
+	}
+	if l.projectName != "" {
+		f += fmt.Sprintf(", project %q (ID=%d)", l.projectName, l.projectID)
+	}
+	if l.model != "" {
+		f += fmt.Sprintf(", model %q (ID=%d)", l.model, l.modelID)
+	}
+	return f + "]"
+}
+
+func (l *reqLogger) Info(format string, args ...any) {
+	reqPrint(l.r, "INF ", "%s "+format, append([]any{l.fields()}, args...)...)
+}
+
+func (l *reqLogger) Error(format string, args ...any) {
+	reqPrint(l.r, "ERR ", "%s "+format, append([]any{l.fields()}, args...)...)
+}
+
+// apiError writes an error in OpenAI's JSON error format, so that OpenAI
+// client libraries classify (and retry or back off on) the proxy's own
+// rejections the same way as upstream ones. Empty code is sent as null.
+func apiError(w http.ResponseWriter, status int, errType string, code string, message string) {
+	var body struct {
+		Error struct {
+			Message string  `json:"message"`
+			Type    string  `json:"type"`
+			Param   *string `json:"param"`
+			Code    *string `json:"code"`
+		} `json:"error"`
+	}
+	body.Error.Message = message
+	body.Error.Type = errType
+	if code != "" {
+		body.Error.Code = &code
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// httpError is a replacement for http.Error that uses the OpenAI error
+// type and code conventional for the status.
+func httpError(w http.ResponseWriter, message string, status int) {
+	errType := "invalid_request_error"
+	if status >= 500 {
+		errType = "server_error"
+	}
+
+	var code string
+	switch status {
+	case http.StatusUnauthorized:
+		code = "invalid_api_key"
+	case http.StatusTooManyRequests:
+		code = "rate_limit_exceeded"
+	}
+
+	apiError(w, status, errType, code, message)
+}
+
 func getMessageFromSSE(sseMsg string) string {
 	var msg string
 	for _, line := range strings.Split(sseMsg, "\n") {
@@ -71,12 +330,89 @@ func getMessageFromSSE(sseMsg string) string {
 	return msg
 }
 
-func proxySSEResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, conn *sqlite.Conn, userName string, userID int64, projectName string, projectID int64, modelID int64, crb completionRequestBody, tk tokenizer.Codec) {
+// promptTexts returns the texts of the prompt, whichever API the request
+// is for.
+func (crb completionRequestBody) promptTexts() []string {
+	texts := []string(crb.Input)
+	if crb.Instructions != "" {
+		texts = append(texts, crb.Instructions)
+	}
+	for _, message := range crb.Messages {
+		texts = append(texts, message.Content)
+	}
+	return texts
+}
+
+// requestHash returns a hex SHA-256 of the model and body of a request,
+// to tell retries from other requests reusing an X-Idempotency-Key.
+func requestHash(model string, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", model)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// promptHash returns a hex SHA-256 of the prompt texts, or "" if there are
+// none (transcriptions).
+func promptHash(crb completionRequestBody) string {
+	texts := crb.promptTexts()
+	if len(texts) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, text := range texts {
+		// Length-prefixed, so that the split into texts matters too
+		fmt.Fprintf(h, "%d:%s", len(text), text)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Encodings of the models supported by the tokenizer
+var tokenizerEncodings = []tokenizer.Encoding{tokenizer.Cl100kBase, tokenizer.P50kBase, tokenizer.P50kEdit, tokenizer.R50kBase}
+
+// checkTokenizer loads every tokenizer encoding and encodes a text with
+// it, so that a broken tokenizer fails the start of the server instead of
+// each request.
+func checkTokenizer() error {
+	for _, enc := range tokenizerEncodings {
+		tk, err := tokenizer.Get(enc)
+		if err != nil {
+			return fmt.Errorf("failed to load encoding %s: %w", enc, err)
+		}
+		if _, _, err := tk.Encode("Hello, world!"); err != nil {
+			return fmt.Errorf("failed to encode with %s: %w", enc, err)
+		}
+	}
+	return nil
+}
+
+func countPromptTokens(tk tokenizer.Codec, crb completionRequestBody) (int, error) {
+	nTokens := 0
+	for _, text := range crb.promptTexts() {
+		ids, _, err := tk.Encode(text)
+		if err != nil {
+			return 0, err
+		}
+		nTokens += len(ids)
+	}
+	return nTokens, nil
+}
+
+func proxySSEResponse(w http.ResponseWriter, l *reqLogger, resp *http.Response, crb completionRequestBody, tk tokenizer.Codec, maxDuration time.Duration, flushPerEvent, sendUsage bool) requestUsage {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		logError(r, "Unable to get flusher for response")
-		http.Error(w, "Streaming setup failed", http.StatusInternalServerError)
-		return
+		l.Error("Unable to get flusher for response")
+		httpError(w, "Streaming setup failed", http.StatusInternalServerError)
+		return requestUsage{}
+	}
+
+	// The response must reach the client even if accounting fails, so
+	// tokenizer failures only make the usage estimate incomplete.
+	nTokens, err := countPromptTokens(tk, crb)
+	if err != nil {
+		l.Error("Failed to tokenize prompt, not counting it: %v", err)
+	} else {
+		l.Info("Tokenized prompt: %d tokens", nTokens)
 	}
 
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -85,228 +421,1505 @@ func proxySSEResponse(w http.ResponseWriter, r *http.Request, resp *http.Respons
 	w.WriteHeader(http.StatusOK)
 	flusher.Flush()
 
-	nTokens := 0
-	for _, message := range crb.Messages {
-		ids, _, err := tk.Encode(message.Content)
-		if err != nil {
-			logError(r, "Failed to tokenize prompt for user %q (ID=%d), project %q (ID=%d), model %q (ID=%d): %v", userName, userID, projectName, projectID, crb.Model, modelID, err)
-			http.Error(w, "failed to tokenize prompt", http.StatusBadGateway)
-			return
-		}
-		nTokens += len(ids)
-	}
+	// Once the status is sent errors can't be reported to the client, so
+	// from here on problems are only logged, the stream is ended and the
+	// usage accrued so far is returned.
 
-	logInfo(r, "Tokenized prompt for user %q (ID=%d), project %q (ID=%d), model %q (ID=%d): %d tokens", userName, userID, projectName, projectID, crb.Model, modelID, nTokens)
+	// Tokenizing every delta on the streaming path adds latency between
+	// messages, so the completion is accumulated and tokenized once at the
+	// end. It is only used if upstream does not report usage.
+	var usage responseUsage
+	var deltas []string
+
+	// Closing the body makes the blocked read below fail, which ends the
+	// stream even if upstream hangs without sending anything.
+	var durationExceeded atomic.Bool
+	if maxDuration != 0 {
+		timer := time.AfterFunc(maxDuration, func() {
+			durationExceeded.Store(true)
+			resp.Body.Close()
+		})
+		defer timer.Stop()
+	}
 
-	// Read the response line-by-line and send it to the client
+	// Read the response line-by-line and send it to the client. The stream
+	// should end with [DONE], but upstream may close it before that.
 	reader := bufio.NewReader(resp.Body)
-	for {
+	eof := false
+stream:
+	for !eof {
 		var msg string
 		for {
 			line, err := reader.ReadString('\n')
-			if err != nil {
-				logError(r, "Failed to read response body for user %q (ID=%d), project %q (ID=%d), model %q (ID=%d): %v", userName, userID, projectName, projectID, crb.Model, modelID, err)
-				http.Error(w, "failed to read response", http.StatusBadGateway)
-				return
+			if err != nil && durationExceeded.Load() {
+				l.Error("Stream exceeded %s, closing it", maxDuration)
+				break stream
+			}
+			if err != nil && err != io.EOF {
+				l.Error("Failed to read response body: %v", err)
+				break stream
 			}
 			fmt.Fprint(w, line)
-			flusher.Flush()
-
-			if line == "\n" {
-				// End of message
-				break
+			if !flushPerEvent || line == "\n" || err == io.EOF {
+				flusher.Flush()
 			}
 
 			if strings.HasPrefix(line, "data:") {
 				msg += strings.TrimSpace(line[5:])
 			}
+
+			if err == io.EOF {
+				l.Error("Stream closed by upstream without [DONE]")
+				eof = true
+				break
+			}
+			if line == "\n" {
+				// End of message
+				break
+			}
 		}
 
+		if msg == "" {
+			continue
+		}
 		if msg == "[DONE]" {
 			break
 		}
 
-		fmt.Printf("msg: %q\n", msg)
-
 		var respBody completionResponseStreamedBody
 		if err := json.Unmarshal([]byte(msg), &respBody); err != nil {
-			logError(r, "Failed to unmarshal response body for user %q (ID=%d), project %q (ID=%d), model %q (ID=%d): %v", userName, userID, projectName, projectID, crb.Model, modelID, err)
-			http.Error(w, "failed to unmarshal response", http.StatusBadGateway)
-			return
+			l.Error("Failed to unmarshal response body, skipping message: %v", err)
+			continue
+		}
+		if respBody.Usage != nil {
+			usage = *respBody.Usage
+		}
+		if len(respBody.Choices) == 0 && respBody.Usage != nil {
+			continue
 		}
 		if len(respBody.Choices) != 1 {
-			logError(r, "0 or more than 1 choices in response body for user %q (ID=%d), project %q (ID=%d), model %q (ID=%d)", userName, userID, projectName, projectID, crb.Model, modelID)
-			http.Error(w, "0 or more than 1 choices in response", http.StatusBadGateway)
-			return
+			l.Error("0 or more than 1 choices in response body, skipping message")
+			continue
 		}
 
-		ids, _, err := tk.Encode(respBody.Choices[0].Delta.Content)
-		if err != nil {
-			logError(r, "Failed to tokenize message for user %q (ID=%d), project %q (ID=%d), model %q (ID=%d): %v", userName, userID, projectName, projectID, crb.Model, modelID, err)
-			http.Error(w, "failed to tokenize message", http.StatusBadGateway)
-			return
+		delta := respBody.Choices[0].Delta
+		deltas = append(deltas, delta.Content)
+		for _, call := range delta.ToolCalls {
+			deltas = append(deltas, call.Function.Name, call.Function.Arguments)
 		}
-		nTokens += len(ids)
 	}
 
-	logInfo(r, "SSE response read. user %q (ID=%d), project %q (ID=%d), model %q (ID=%d), tokens %d", userName, userID, projectName, projectID, crb.Model, modelID, nTokens)
+	var ru requestUsage
+	switch {
+	case usage.tokens() != 0:
+		l.Info("SSE response read, reported tokens %d", usage.tokens())
+		checkPromptEstimate(l, tk, crb, usage.promptTokens())
+		ru = usage.usage()
+	case len(deltas) == 0:
+		// No generation happened, so there is nothing to charge for, not
+		// even the prompt.
+		l.Info("SSE response without deltas, not saving usage")
+	default:
+		promptTokens := nTokens
+		nTokens += countCompletionTokens(l, tk, deltas)
+		l.Info("SSE response read, tokens %d", nTokens)
+		ru = requestUsage{tokens: nTokens, promptTokens: promptTokens}
+	}
 
-	if err := saveUsage(conn, modelID, projectID, nTokens); err != nil {
-		logError(r, "Failed to save usage for user %q (ID=%d), project %q (ID=%d), model %q (ID=%d), tokens %d: %v", userName, userID, projectName, projectID, crb.Model, modelID, nTokens, err)
+	if sendUsage {
+		writeUsageEvent(w, flusher, l, proxyUsage{
+			PromptTokens:     ru.promptTokens,
+			CompletionTokens: ru.tokens - ru.promptTokens,
+			TotalTokens:      ru.tokens,
+			Estimated:        usage.tokens() == 0,
+		})
 	}
+	return ru
 }
 
-func proxyPlainResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, conn *sqlite.Conn, userName string, userID int64, projectName string, projectID int64, modelID int64, crb completionRequestBody) {
-	responseBody, err := io.ReadAll(resp.Body)
+// proxyUsage is the data of the proxy_usage event sent at the end of
+// streamed chat completions on request.
+type proxyUsage struct {
+	PromptTokens     int  `json:"prompt_tokens"`
+	CompletionTokens int  `json:"completion_tokens"`
+	TotalTokens      int  `json:"total_tokens"`
+	Estimated        bool `json:"estimated"`
+}
+
+func writeUsageEvent(w io.Writer, flusher http.Flusher, l *reqLogger, u proxyUsage) {
+	b, err := json.Marshal(u)
 	if err != nil {
-		logError(r, "Failed to read response body for user %q (ID=%d), project %q (ID=%d), model %q (ID=%d): %v", userName, userID, projectName, projectID, crb.Model, modelID, err)
-		http.Error(w, "failed to read response", http.StatusBadGateway)
+		l.Error("Failed to encode usage event: %v", err)
 		return
 	}
-
-	var crespb completionResponseBody
-	if err := json.Unmarshal(responseBody, &crespb); err != nil {
-		logError(r, "Failed to parse response body for user %q (ID=%d), project %q (ID=%d), model %q (ID=%d): %v", userName, userID, projectName, projectID, crb.Model, modelID, err)
-		http.Error(w, "failed to parse response", http.StatusBadGateway)
+	if _, err := fmt.Fprintf(w, "event: proxy_usage\ndata: %s\n\n", b); err != nil {
+		l.Error("Failed to write usage event: %v", err)
 		return
 	}
+	flusher.Flush()
+}
 
-	logInfo(r, "200 response read. user %q (ID=%d), project %q (ID=%d), model %q (ID=%d), tokens %d", userName, userID, projectName, projectID, crb.Model, modelID, crespb.Usage.TotalTokens)
-
-	if err := saveUsage(conn, modelID, projectID, crespb.Usage.TotalTokens); err != nil {
-		logError(r, "Failed to save usage for user %q (ID=%d), project %q (ID=%d), model %q (ID=%d), tokens %d: %v", userName, userID, projectName, projectID, crb.Model, modelID, crespb.Usage.TotalTokens, err)
+// countCompletionTokens tokenizes the deltas of a streamed completion. If
+// the completion fails to tokenize as a whole, the deltas are tokenized
+// one by one, and those failing are logged and not counted.
+func countCompletionTokens(l *reqLogger, tk tokenizer.Codec, deltas []string) int {
+	ids, _, err := tk.Encode(strings.Join(deltas, ""))
+	if err == nil {
+		return len(ids)
 	}
+	l.Error("Failed to tokenize message, tokenizing deltas separately: %v", err)
 
-	if _, err := w.Write(responseBody); err != nil {
-		logError(r, "Failed to write response body for user %q (ID=%d), project %q (ID=%d), model %q (ID=%d): %v", userName, userID, projectName, projectID, crb.Model, modelID, err)
+	nTokens, nSkipped := 0, 0
+	for _, delta := range deltas {
+		ids, _, err := tk.Encode(delta)
+		if err != nil {
+			nSkipped++
+			continue
+		}
+		nTokens += len(ids)
 	}
-
-	logInfo(r, "200 response sent. user %q (ID=%d), project %q (ID=%d), model %q (ID=%d)", userName, userID, projectName, projectID, crb.Model, modelID)
+	if nSkipped != 0 {
+		l.Error("Not counting %d of %d deltas that failed to tokenize", nSkipped, len(deltas))
+	}
+	return nTokens
 }
 
-func proxyRequest(w http.ResponseWriter, r *http.Request, client *http.Client, key string, pool *sqlitemigration.Pool) {
-	if r.Method != http.MethodPost {
-		logError(r, "Unexpected method %q", r.Method)
-		http.Error(w, "Only POST requests are supported", http.StatusBadRequest)
+// Prompt token estimates differing from the upstream count by more than
+// this fraction (and more than a few tokens of per-message overhead) are
+// logged, as they suggest the tokenizer does not match the model.
+const (
+	promptEstimateTolerance    = 0.2
+	promptEstimateMinDeviation = 10
+)
+
+func checkPromptEstimate(l *reqLogger, tk tokenizer.Codec, crb completionRequestBody, reported int) {
+	if reported == 0 {
 		return
 	}
-	if r.URL.RawQuery != "" {
-		logError(r, "Unexpected query %q", r.URL.RawQuery)
-		http.Error(w, "Query parameters are not supported", http.StatusBadRequest)
+	estimate, err := countPromptTokens(tk, crb)
+	if err != nil {
+		l.Error("Failed to tokenize prompt: %v", err)
 		return
 	}
+	deviation := estimate - reported
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	if deviation > promptEstimateMinDeviation && float64(deviation) > promptEstimateTolerance*float64(reported) {
+		l.Info("Prompt token estimate %d diverges from upstream count %d", estimate, reported)
+	}
+}
 
-	// We do not use request's context, as we want to count requests that were aborted by the client too.
-	// Instead we use a new context with a timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
+var errResponseTooLarge = errors.New("response too large")
 
-	conn := mustGetDB(ctx, pool)
-	defer pool.Put(conn)
+const plainResponseProgressInterval = 10 * time.Second
 
-	reqKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	userID, userName, userFound, err := findUserByKey(conn, reqKey)
-	if err != nil {
-		logError(r, "Failed to find user by key: %v", err)
-		http.Error(w, "Failed to find user", http.StatusInternalServerError)
-		return
+// readPlainResponse reads a non-streamed response body, logging the
+// progress of slow ones. Bodies larger than maxSize (0 means no limit)
+// fail with errResponseTooLarge.
+func readPlainResponse(l *reqLogger, body io.Reader, maxSize int) ([]byte, error) {
+	var buf bytes.Buffer
+	chunk := make([]byte, 32*1024)
+	start := time.Now()
+	lastProgress := start
+	for {
+		n, err := body.Read(chunk)
+		buf.Write(chunk[:n])
+		if maxSize != 0 && buf.Len() > maxSize {
+			return nil, errResponseTooLarge
+		}
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if now := time.Now(); now.Sub(lastProgress) >= plainResponseProgressInterval {
+			l.Info("Still reading response, %d bytes in %s", buf.Len(), now.Sub(start).Round(time.Second))
+			lastProgress = now
+		}
 	}
-	if !userFound {
-		logError(r, "User not found by key %q", reqKey)
-		http.Error(w, "Invalid API key", http.StatusUnauthorized)
-		return
+}
+
+// readPlainResponseOrFail is readPlainResponse responding with an error
+// if reading fails.
+func readPlainResponseOrFail(w http.ResponseWriter, l *reqLogger, resp *http.Response, maxSize int) ([]byte, bool) {
+	responseBody, err := readPlainResponse(l, resp.Body, maxSize)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		l.Error("Response not complete before the deadline")
+		httpError(w, "timed out reading response", http.StatusGatewayTimeout)
+		return nil, false
+	case errors.Is(err, errResponseTooLarge):
+		l.Error("Response larger than %d bytes", maxSize)
+		httpError(w, "response too large", http.StatusBadGateway)
+		return nil, false
+	case err != nil:
+		l.Error("Failed to read response body: %v", err)
+		httpError(w, "failed to read response", http.StatusBadGateway)
+		return nil, false
 	}
+	return responseBody, true
+}
 
-	projectName := r.Header.Get("X-Project")
-	if projectName == "" {
-		projectName = "<default>"
+// Smaller responses are not worth compressing.
+const minGzipResponseSize = 1024
+
+// acceptsGzip reports whether the client's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+				if q, err := strconv.ParseFloat(params[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+			return true
+		}
 	}
+	return false
+}
 
-	projectID, err := getProjectID(conn, userID, projectName)
-	if err != nil {
-		logError(r, "Failed to get project ID for user %q (ID=%d), project %q: %v", userName, userID, projectName, err)
-		http.Error(w, "failed to find project", http.StatusInternalServerError)
-		return
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	requestBody, err := io.ReadAll(r.Body)
-	if err != nil {
-		logError(r, "Failed to read request body for user %q (ID=%d), project %q (ID=%d): %v", userName, userID, projectName, projectID, err)
-		http.Error(w, "failed to read request body", http.StatusInternalServerError)
-		return
+// proxyPlainResponse sends the response to the client, gzipped if
+// acceptGzip is set and it is large enough.
+func proxyPlainResponse(w http.ResponseWriter, l *reqLogger, resp *http.Response, crb completionRequestBody, tk tokenizer.Codec, maxSize int, acceptGzip, estimate bool) requestUsage {
+	responseBody, ok := readPlainResponseOrFail(w, l, resp, maxSize)
+	if !ok {
+		return requestUsage{}
 	}
 
-	var crb completionRequestBody
-	if err := json.Unmarshal(requestBody, &crb); err != nil {
-		logError(r, "Failed to parse request body for user %q (ID=%d), project %q (ID=%d): %v", userName, userID, projectName, projectID, err)
-		http.Error(w, "failed to parse request body", http.StatusBadRequest)
-		return
+	var crespb completionResponseBody
+	if err := json.Unmarshal(responseBody, &crespb); err != nil {
+		l.Error("Failed to parse response body: %v", err)
+		httpError(w, "failed to parse response", http.StatusBadGateway)
+		return requestUsage{}
 	}
 
-	tk, err := tokenizer.ForModel(tokenizer.Model(crb.Model))
-	if err != nil {
-		logError(r, "Invalid model %q requested by user %q (ID=%d), project %q (ID=%d): %v", crb.Model, userName, userID, projectName, projectID, err)
-		http.Error(w, "failed to find model "+crb.Model, http.StatusBadRequest)
-		return
+	nTokens := crespb.Usage.tokens()
+	l.Info("200 response read, tokens %d, cached %d", nTokens, crespb.Usage.cachedTokens())
+	checkPromptEstimate(l, tk, crb, crespb.Usage.promptTokens())
+
+	if nTokens == 0 {
+		l.Info("200 response without usage, not saving usage")
 	}
 
-	modelID, err := getModelID(conn, crb.Model)
-	if err != nil {
-		logError(r, "Failed to get model ID for model %q, requested by user %q (ID=%d), project %q (ID=%d): %v", crb.Model, userName, userID, projectName, projectID, err)
-		http.Error(w, "failed to get model "+crb.Model, http.StatusInternalServerError)
-		return
+	w.Header().Add("Vary", "Accept-Encoding")
+	if acceptGzip && len(responseBody) >= minGzipResponseSize {
+		if compressed, err := gzipBytes(responseBody); err != nil {
+			l.Error("Failed to compress response, sending it uncompressed: %v", err)
+		} else {
+			responseBody = compressed
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(responseBody)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(responseBody); err != nil {
+		l.Error("Failed to write response body: %v", err)
 	}
 
-	logInfo(r, "Proxying. user %q (ID=%d), project %q (ID=%d), model %q (ID=%d)", userName, userID, projectName, projectID, crb.Model, modelID)
+	l.Info("200 response sent")
 
-	req := must.OK1(http.NewRequestWithContext(ctx, http.MethodPost, openaiURL+"/v1/chat/completions", bytes.NewReader(requestBody)))
-	req.Header = r.Header.Clone()
-	req.Header.Set("Authorization", "Bearer "+key)
-	resp, err := client.Do(req)
+	ru := crespb.Usage.usage()
+	if estimate && nTokens != 0 {
+		ru.estimatedTokens = estimateTokens(l, tk, crb, crespb.completionText())
+	}
+	return ru
+}
 
-	// Network failures etc.
+// estimateTokens counts the tokens of the prompt and the completion with
+// the tokenizer, for comparing with the upstream count. It returns 0 if
+// tokenization fails, as a partial count would skew the comparison.
+func estimateTokens(l *reqLogger, tk tokenizer.Codec, crb completionRequestBody, completion string) int {
+	prompt, err := countPromptTokens(tk, crb)
 	if err != nil {
-		logError(r, "Failed to proxy request for user %q (ID=%d), project %q (ID=%d), model %q (ID=%d): %v", userName, userID, projectName, projectID, crb.Model, modelID, err)
-		http.Error(w, fmt.Sprintf("Failed to read response from OpenAI: %v", err), http.StatusBadGateway)
-		return
+		l.Error("Failed to tokenize prompt, not storing estimate: %v", err)
+		return 0
+	}
+	ids, _, err := tk.Encode(completion)
+	if err != nil {
+		l.Error("Failed to tokenize completion, not storing estimate: %v", err)
+		return 0
 	}
+	return prompt + len(ids)
+}
 
-	defer resp.Body.Close()
+type serverConfig struct {
+	// Key used for upstream requests.
+	openaiKey string
+	// Read-only pool used by admin reports of the default tenant, nil to
+	// use its pool.
+	reportPool *sqlitex.Pool
+	// Saved usage is written to usageStream as NDJSON if it is not nil.
+	usageStream io.Writer
+	// Base URL of the upstream API.
+	upstreamURL string
+	// Replaces the /v1 prefix of request paths upstream.
+	upstreamPathPrefix string
+	// Transport of upstream requests, nil for http.DefaultTransport.
+	upstreamTransport http.RoundTripper
+	// The key is sent upstream in the upstreamAuthHeader header, formatted
+	// by replacing {key} in upstreamAuthFormat.
+	upstreamAuthHeader string
+	upstreamAuthFormat string
+	// Requests asking for more than maxTokensPerRequest completion tokens
+	// (max_tokens) are rejected. 0 means no limit.
+	maxTokensPerRequest int
+	// Requests with prompts longer than maxPromptTokens are rejected. 0 means no limit.
+	maxPromptTokens int
+	// max_tokens (max_output_tokens for the Responses API) of requests is
+	// capped to forceMaxTokens before proxying, and set if missing. 0
+	// means no cap.
+	forceMaxTokens int
+	// Requests using fewer than minTokensPerRequest tokens are recorded
+	// and counted by the rate limiter as using minTokensPerRequest.
+	// Transcriptions, billed by seconds, and requests that used no tokens
+	// at all are left as they are. 0 means no minimum.
+	minTokensPerRequest int
+	// Users can't create more than maxProjectsPerUser projects. 0 means no limit.
+	maxProjectsPerUser int
+	// X-Project values longer than maxProjectNameLength bytes, with
+	// unprintable characters or not matching projectNamePattern (if not
+	// nil) are rejected.
+	maxProjectNameLength int
+	projectNamePattern   *regexp.Regexp
+	// Requests for projects that don't exist are rejected instead of
+	// creating them if disableProjectAutocreate is set.
+	disableProjectAutocreate bool
+	// Origins allowed to call the proxy from browsers. "*" allows any
+	// origin. Empty disables CORS handling.
+	corsOrigins []string
+	// Address to serve the admin API on. Empty disables the admin API.
+	adminListenURL string
+	// Bearer token required by the admin API.
+	adminToken string
+	// Path prefix of /healthz, /status and the admin API, without a
+	// trailing slash. Empty serves them at the root.
+	adminPathPrefix string
+	// Request bodies are stored for audit if storeRequestBodies is set,
+	// truncated to maxStoredBodySize bytes (0 means no limit).
+	storeRequestBodies bool
+	maxStoredBodySize  int
+	// Streamed responses are cut off after maxStreamDuration, with the
+	// usage accumulated so far recorded. 0 means no limit.
+	maxStreamDuration time.Duration
+	// Streamed responses are flushed to the client after every line, or
+	// only at the end of every event if flushPerEvent is set.
+	flushPerEvent bool
+	// Client request headers forwarded upstream, others are dropped.
+	// Authorization is always replaced with the upstream key.
+	forwardHeaders []string
+	// Failed upstream requests are retried upstreamRetries times, after a
+	// randomized backoff of at most maxUpstreamRetriesBackoff.
+	upstreamRetries           int
+	maxUpstreamRetriesBackoff time.Duration
+	// Successful key lookups are cached for userCacheTTL, up to
+	// userCacheSize keys. 0 disables the cache.
+	userCacheSize int
+	userCacheTTL  time.Duration
+	// Non-streamed responses larger than maxResponseSize bytes are
+	// rejected. 0 means no limit.
+	maxResponseSize int
+	// Usage is stored per request if usageGranularity is empty, or summed
+	// into "hour" or "day" buckets.
+	usageGranularity string
+	// Usage of requests repeating an X-Idempotency-Key of the same project
+	// within idempotencyTTL is not saved again.
+	idempotencyTTL time.Duration
+	// Hashes of prompts are stored with usage if storePromptHashes is set.
+	storePromptHashes bool
+	// Tokenizer estimates of non-streamed requests are stored with usage,
+	// next to the upstream counts, if storeTokenEstimates is set.
+	storeTokenEstimates bool
+	// Requests from trustedProxies with the trustedAuthHeader header are
+	// made on behalf of the user named by it, without checking the key.
+	// Empty trustedAuthHeader disables this.
+	trustedAuthHeader string
+	trustedProxies    []*net.IPNet
+	// X-Test is only honoured for requests of testUsers and from
+	// trustedProxies, so that other users can't hide their usage from
+	// reports.
+	testUsers map[string]bool
+	// Requests and tokens per minute of each user, unless the user has
+	// limits of their own. 0 means no limit.
+	rateLimitRPM int
+	rateLimitTPM int
+	// If keyPrefix is not empty, keys without it are rejected without
+	// looking them up.
+	keyPrefix string
+	// Keys matching passthroughKeyPattern (if not nil) are upstream keys
+	// of the clients themselves, used instead of openaiKey. Their requests
+	// are made on behalf of passthroughUser, or proxied as they are
+	// without recording usage if it is empty.
+	passthroughKeyPattern *regexp.Regexp
+	passthroughUser       string
+}
 
-	h := w.Header()
-	for k, vs := range resp.Header {
-		h.Del(k)
-		for _, v := range vs {
-			h.Add(k, v)
+type server struct {
+	serverConfig
+
+	// Database pools by tenant name (X-Tenant header). The default
+	// tenant, used for requests without the header, has an empty name.
+	pools   map[string]*sqlitemigration.Pool
+	client  *http.Client
+	limiter *rateLimiter
+	// nil if disabled
+	userCache *userCache
+	// When draining, /healthz fails but requests are still served.
+	draining atomic.Bool
+
+	// Process lifetime counters reported by /status
+	started  time.Time
+	requests atomic.Int64
+	tokens   atomic.Int64
+	inFlight atomic.Int64
+	// Rate limits of the upstream account reported with the latest
+	// response, nil before the first one
+	upstreamLimits atomic.Pointer[upstreamRateLimits]
+
+	// Keeps concurrent usage events from interleaving
+	usageStreamMu sync.Mutex
+}
+
+// upstreamRateLimits are the x-ratelimit-* headers of an upstream
+// response, -1 where a header is missing.
+type upstreamRateLimits struct {
+	LimitRequests     int64     `json:"limit_requests"`
+	LimitTokens       int64     `json:"limit_tokens"`
+	RemainingRequests int64     `json:"remaining_requests"`
+	RemainingTokens   int64     `json:"remaining_tokens"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// parseUpstreamRateLimits parses the rate limit headers of an upstream
+// response, and reports whether it has any.
+func parseUpstreamRateLimits(h http.Header) (upstreamRateLimits, bool) {
+	found := false
+	get := func(name string) int64 {
+		n, err := strconv.ParseInt(h.Get(name), 10, 64)
+		if err != nil {
+			return -1
 		}
+		found = true
+		return n
 	}
-	w.WriteHeader(resp.StatusCode)
+	limits := upstreamRateLimits{
+		LimitRequests:     get("x-ratelimit-limit-requests"),
+		LimitTokens:       get("x-ratelimit-limit-tokens"),
+		RemainingRequests: get("x-ratelimit-remaining-requests"),
+		RemainingTokens:   get("x-ratelimit-remaining-tokens"),
+		UpdatedAt:         time.Now().UTC(),
+	}
+	return limits, found
+}
 
-	if resp.StatusCode != http.StatusOK {
-		if _, err := io.Copy(w, resp.Body); err != nil {
-			logError(r, "Failed to write response body for user %q (ID=%d), project %q (ID=%d), model %q (ID=%d): %v", userName, userID, projectName, projectID, crb.Model, modelID, err)
+func (s *server) tenantPool(r *http.Request) (string, *sqlitemigration.Pool, bool) {
+	name := r.Header.Get("X-Tenant")
+	pool, ok := s.pools[name]
+	return name, pool, ok
+}
+
+// retryBackoff returns the delay before retry attempt (counting from 0):
+// a random duration up to an exponentially growing bound, capped at
+// maxBackoff. The full jitter keeps requests that failed together from
+// retrying together.
+func retryBackoff(attempt int, maxBackoff time.Duration) time.Duration {
+	bound := maxBackoff
+	if attempt < 32 && upstreamRetryBaseBackoff<<attempt < maxBackoff {
+		bound = upstreamRetryBaseBackoff << attempt
+	}
+	if bound <= 0 {
+		return 0
+	}
+	return time.Duration(mathrand.Int63n(int64(bound)))
+}
+
+const upstreamRetryBaseBackoff = 500 * time.Millisecond
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// upstreamPath maps a /v1/... request path to the upstream path.
+func upstreamPath(prefix, path string) string {
+	return prefix + strings.TrimPrefix(path, "/v1")
+}
+
+// doUpstream sends the request upstream with upstreamKey, retrying network
+// failures, 429 and 5xx responses up to upstreamRetries times. The last
+// failure is returned as is.
+func (s *server) doUpstream(ctx context.Context, l *reqLogger, r *http.Request, requestBody []byte, upstreamKey string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req := must.OK1(http.NewRequestWithContext(ctx, http.MethodPost, s.upstreamURL+upstreamPath(s.upstreamPathPrefix, r.URL.Path), bytes.NewReader(requestBody)))
+		for _, name := range s.forwardHeaders {
+			for _, v := range r.Header.Values(name) {
+				req.Header.Add(name, v)
+			}
 		}
+		req.Header.Set(s.upstreamAuthHeader, strings.ReplaceAll(s.upstreamAuthFormat, "{key}", upstreamKey))
+		resp, err := s.client.Do(req)
 
-		logInfo(r, "Error response sent. %s, user %q (ID=%d), project %q (ID=%d), model %q (ID=%d)", resp.Status, userName, userID, projectName, projectID, crb.Model, modelID)
-		return
+		if attempt == s.upstreamRetries || (err == nil && !retryableStatus(resp.StatusCode)) {
+			return resp, err
+		}
+
+		if err != nil {
+			l.Error("Upstream request failed, retrying: %v", err)
+		} else {
+			l.Error("Upstream responded %s, retrying", resp.Status)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(retryBackoff(attempt, s.maxUpstreamRetriesBackoff)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
+}
 
-	if crb.Stream {
-		proxySSEResponse(w, r, resp, conn, userName, userID, projectName, projectID, modelID, crb, tk)
-	} else {
-		proxyPlainResponse(w, r, resp, conn, userName, userID, projectName, projectID, modelID, crb)
+// checkProjectName validates a project name from the X-Project header, so
+// that arbitrary header values don't create garbage projects.
+func (s *server) checkProjectName(name string) error {
+	if len(name) > s.maxProjectNameLength {
+		return fmt.Errorf("longer than %d bytes", s.maxProjectNameLength)
 	}
+	if !utf8.ValidString(name) {
+		return errors.New("not valid UTF-8")
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("contains unprintable character %q", r)
+		}
+	}
+	if s.projectNamePattern != nil && !s.projectNamePattern.MatchString(name) {
+		return fmt.Errorf("does not match %s", s.projectNamePattern)
+	}
+	return nil
 }
 
-func serve(pool *sqlitemigration.Pool, listenURL string) {
-	openaiKey := os.Getenv("OPENAI_KEY")
-	client := &http.Client{}
+// trustedUser returns the user name from the trusted auth header, if the
+// request has it and comes from a trusted proxy. Otherwise the user is
+// authenticated by key.
+func (s *server) trustedUser(r *http.Request) string {
+	if s.trustedAuthHeader == "" {
+		return ""
+	}
+	userName := r.Header.Get(s.trustedAuthHeader)
+	if userName == "" || !s.fromTrustedProxy(r) {
+		return ""
+	}
+	return userName
+}
 
-	http.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
-		proxyRequest(w, r, client, openaiKey, pool)
-	})
+// fromTrustedProxy reports whether the request comes from trustedProxies.
+func (s *server) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range s.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// passthroughKey reports whether the request key is the client's own
+// upstream key. Requests of trusted users are never passthrough.
+func (s *server) passthroughKey(trustedUser, reqKey string) bool {
+	return trustedUser == "" && s.passthroughKeyPattern != nil && s.passthroughKeyPattern.MatchString(reqKey)
+}
 
-	if err := http.ListenAndServe(listenURL, nil); err != nil {
-		log.Fatalf("failed to listen on %s: %v", listenURL, err)
+// copyUpstreamHeaders copies the headers of an upstream response to the
+// client response. CORS is the proxy's policy, set by the cors middleware,
+// so upstream Access-Control-* headers are dropped and Vary values are
+// added to the proxy's.
+func copyUpstreamHeaders(h, upstream http.Header) {
+	for k, vs := range upstream {
+		if strings.HasPrefix(k, "Access-Control-") {
+			continue
+		}
+		if k != "Vary" {
+			h.Del(k)
+		}
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+}
+
+// proxyPassthrough proxies a request with the client's own upstream key as
+// it is: no user, limits or usage are involved.
+func (s *server) proxyPassthrough(ctx context.Context, w http.ResponseWriter, l *reqLogger, r *http.Request, upstreamKey string) {
+	requestBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		l.Error("Failed to read request body: %v", err)
+		httpError(w, "failed to read request body", http.StatusInternalServerError)
+		return
+	}
+
+	l.Info("Proxying with passthrough key")
+
+	resp, err := s.doUpstream(ctx, l, r, requestBody, upstreamKey)
+	if err != nil {
+		l.Error("Failed to proxy request: %v", err)
+		httpError(w, fmt.Sprintf("Failed to read response from OpenAI: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	h := w.Header()
+	copyUpstreamHeaders(h, resp.Header)
+	w.WriteHeader(resp.StatusCode)
+
+	// Streamed responses have to reach the client as they arrive
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				l.Error("Failed to write response body: %v", err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			l.Error("Failed to read response body: %v", err)
+			return
+		}
+	}
+
+	l.Info("Passthrough response sent. %s", resp.Status)
+}
+
+// findUser is findUserByKey behind the user cache, if enabled.
+func (s *server) findUser(conn *sqlite.Conn, tenantName, apiKey string) (_ int64, _ string, expired bool, found bool, _ error) {
+	if s.userCache == nil {
+		return findUserByKey(conn, apiKey)
+	}
+
+	cacheKey := tenantName + "\x00" + apiKey
+	if u, ok := s.userCache.get(cacheKey); ok {
+		return u.id, u.name, u.expired, true, nil
+	}
+	userID, userName, expired, found, err := findUserByKey(conn, apiKey)
+	if err == nil && found {
+		s.userCache.add(cachedUser{key: cacheKey, id: userID, name: userName, expired: expired})
+	}
+	return userID, userName, expired, found, err
+}
+
+// parseProxyTimeout parses an X-Proxy-Timeout header value, in seconds.
+// Timeouts beyond requestTimeout are returned as requestTimeout.
+func parseProxyTimeout(v string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	if !(seconds > 0) {
+		return 0, errors.New("not positive")
+	}
+	if seconds >= requestTimeout.Seconds() {
+		return requestTimeout, nil
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// parseAuthorization returns the key in an Authorization header value and
+// the format it was given in, for logging. Besides the standard
+// "Bearer <key>", clients send "Token <key>" and bare keys, so these are
+// accepted too. Schemes are matched regardless of case.
+func parseAuthorization(v string) (key, format string) {
+	if v == "" {
+		return "", "missing"
+	}
+	scheme, rest, found := strings.Cut(v, " ")
+	switch {
+	case !found:
+		return v, "bare key"
+	case strings.EqualFold(scheme, "Bearer"), strings.EqualFold(scheme, "Token"):
+		return strings.TrimSpace(rest), scheme
+	default:
+		return v, fmt.Sprintf("unsupported scheme %q", scheme)
+	}
+}
+
+// authenticate finds the user a request is made on behalf of, and the key
+// to use upstream. If it fails, it responds with an error and returns
+// false.
+func (s *server) authenticate(w http.ResponseWriter, l *reqLogger, conn *sqlite.Conn, tenantName, trustedUser, reqKey, keyFormat string, passthrough bool) (userID int64, userName, upstreamKey string, ok bool) {
+	var err error
+	upstreamKey = s.openaiKey
+	switch {
+	case trustedUser != "":
+		var userFound bool
+		userID, userFound, err = findUserByName(conn, trustedUser)
+		if err != nil {
+			l.Error("Failed to find user by name: %v", err)
+			httpError(w, "Failed to find user", http.StatusInternalServerError)
+			return 0, "", "", false
+		}
+		if !userFound {
+			l.Error("User %q from %s header not found", trustedUser, s.trustedAuthHeader)
+			httpError(w, "Unknown user", http.StatusUnauthorized)
+			return 0, "", "", false
+		}
+		userName = trustedUser
+	case passthrough:
+		var userFound bool
+		userID, userFound, err = findUserByName(conn, s.passthroughUser)
+		if err != nil {
+			l.Error("Failed to find user by name: %v", err)
+			httpError(w, "Failed to find user", http.StatusInternalServerError)
+			return 0, "", "", false
+		}
+		if !userFound {
+			l.Error("Passthrough user %q not found", s.passthroughUser)
+			httpError(w, "Failed to find user", http.StatusInternalServerError)
+			return 0, "", "", false
+		}
+		userName = s.passthroughUser
+		upstreamKey = reqKey
+	case s.keyPrefix != "" && !strings.HasPrefix(reqKey, s.keyPrefix):
+		l.Error("Key without prefix %q, Authorization: %s", s.keyPrefix, keyFormat)
+		httpError(w, "Invalid API key", http.StatusUnauthorized)
+		return 0, "", "", false
+	default:
+		var keyExpired, userFound bool
+		userID, userName, keyExpired, userFound, err = s.findUser(conn, tenantName, reqKey)
+		if err != nil {
+			l.Error("Failed to find user by key: %v", err)
+			httpError(w, "Failed to find user", http.StatusInternalServerError)
+			return 0, "", "", false
+		}
+		if !userFound {
+			l.Error("User not found by key %q, Authorization: %s", reqKey, keyFormat)
+			httpError(w, "Invalid API key", http.StatusUnauthorized)
+			return 0, "", "", false
+		}
+		if keyExpired {
+			l.Error("Expired key of user %q (ID=%d)", userName, userID)
+			httpError(w, "key expired", http.StatusUnauthorized)
+			return 0, "", "", false
+		}
+	}
+	return userID, userName, upstreamKey, true
+}
+
+// requestProjectName returns the project of the request. If the project
+// is invalid, it responds with an error and returns false.
+func (s *server) requestProjectName(w http.ResponseWriter, l *reqLogger, r *http.Request) (string, bool) {
+	projectName := r.Header.Get("X-Project")
+	if projectName == "" {
+		return "<default>", true
+	}
+	if err := s.checkProjectName(projectName); err != nil {
+		l.Error("Invalid X-Project header: %v", err)
+		httpError(w, fmt.Sprintf("invalid X-Project header: %v", err), http.StatusBadRequest)
+		return "", false
+	}
+	return projectName, true
+}
+
+// parseRequestBody parses the request body and finds the tokenizer of the
+// requested model. Audio is not tokenized, so transcriptions have no
+// tokenizer and prompt limits do not apply to them. If parsing fails, it
+// responds with an error and returns false.
+func parseRequestBody(w http.ResponseWriter, l *reqLogger, r *http.Request, requestBody []byte) (crb completionRequestBody, tk tokenizer.Codec, ok bool) {
+	var err error
+	if r.URL.Path == transcriptionsPath {
+		crb, err = parseTranscriptionRequest(r.Header.Get("Content-Type"), requestBody)
+		if errors.Is(err, errTranscriptionFormat) {
+			l.Error("Failed to parse request body: %v", err)
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return completionRequestBody{}, nil, false
+		}
+		if err != nil {
+			l.Error("Failed to parse request body: %v", err)
+			httpError(w, "failed to parse request body", http.StatusBadRequest)
+			return completionRequestBody{}, nil, false
+		}
+		if crb.Stream {
+			l.Error("Streamed transcription requested")
+			httpError(w, "streamed transcriptions are not supported", http.StatusBadRequest)
+			return completionRequestBody{}, nil, false
+		}
+	} else {
+		if err := json.Unmarshal(requestBody, &crb); err != nil {
+			l.Error("Failed to parse request body: %v", err)
+			httpError(w, "failed to parse request body", http.StatusBadRequest)
+			return completionRequestBody{}, nil, false
+		}
+
+		tk, err = tokenizer.ForModel(tokenizer.Model(crb.Model))
+		if err != nil {
+			l.Error("Invalid model %q requested: %v", crb.Model, err)
+			httpError(w, "failed to find model "+crb.Model, http.StatusBadRequest)
+			return completionRequestBody{}, nil, false
+		}
+	}
+	return crb, tk, true
+}
+
+// Usage rows can be tagged with X-Usage-Tag for the client's own analytics.
+const maxUsageTagLength = 64
+
+func (s *server) proxyRequest(w http.ResponseWriter, r *http.Request) {
+	l := newReqLogger(r)
+
+	s.requests.Add(1)
+	s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+
+	if r.Method != http.MethodPost {
+		l.Error("Unexpected method %q", r.Method)
+		httpError(w, "Only POST requests are supported", http.StatusBadRequest)
+		return
+	}
+	if r.URL.RawQuery != "" {
+		l.Error("Unexpected query %q", r.URL.RawQuery)
+		httpError(w, "Query parameters are not supported", http.StatusBadRequest)
+		return
+	}
+
+	// We do not use request's context, as we want to count requests that were aborted by the client too.
+	// Instead we use a new context with a timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	// Only the upstream request is limited by X-Proxy-Timeout, so that
+	// usage is still saved when it expires mid-stream.
+	upstreamCtx := ctx
+	if v := r.Header.Get("X-Proxy-Timeout"); v != "" {
+		timeout, err := parseProxyTimeout(v)
+		if err != nil {
+			l.Error("Invalid X-Proxy-Timeout header %q: %v", v, err)
+			httpError(w, "X-Proxy-Timeout must be a positive number of seconds", http.StatusBadRequest)
+			return
+		}
+		if timeout < requestTimeout {
+			var cancelUpstream context.CancelFunc
+			upstreamCtx, cancelUpstream = context.WithTimeout(ctx, timeout)
+			defer cancelUpstream()
+		}
+	}
+
+	tenantName, pool, ok := s.tenantPool(r)
+	l.tenant = tenantName
+	if !ok {
+		l.Error("Unknown tenant %q", tenantName)
+		httpError(w, "Unknown tenant "+tenantName, http.StatusNotFound)
+		return
+	}
+
+	trustedUser := s.trustedUser(r)
+	reqKey, keyFormat := parseAuthorization(r.Header.Get("Authorization"))
+	passthrough := s.passthroughKey(trustedUser, reqKey)
+	if passthrough && s.passthroughUser == "" {
+		s.proxyPassthrough(upstreamCtx, w, l, r, reqKey)
+		return
+	}
+
+	// A database failure must only fail this request, not exit the
+	// server like mustGetDB does.
+	conn, err := pool.Get(ctx)
+	if err != nil {
+		l.Error("Failed to get database connection: %v", err)
+		httpError(w, "database is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer pool.Put(conn)
+
+	userID, userName, upstreamKey, ok := s.authenticate(w, l, conn, tenantName, trustedUser, reqKey, keyFormat, passthrough)
+	if !ok {
+		return
+	}
+	l.userName, l.userID = userName, userID
+	if upstreamKey == "" {
+		// Started without an upstream key for passthrough keys only
+		l.Error("No upstream key configured for keys not matching --passthrough-key-pattern")
+		httpError(w, "no upstream key is configured, only passthrough keys can be used", http.StatusServiceUnavailable)
+		return
+	}
+
+	projectName, ok := s.requestProjectName(w, l, r)
+	if !ok {
+		return
+	}
+
+	projectID, err := getProjectID(conn, userID, projectName, !s.disableProjectAutocreate, s.maxProjectsPerUser)
+	if errors.Is(err, errProjectNotFound) {
+		l.Error("Project %q does not exist", projectName)
+		// Projects are only created explicitly in this mode, so a typo in
+		// X-Project is the likely cause. The list helps spot it.
+		names, err := listUserProjectNames(conn, userID)
+		switch {
+		case err != nil:
+			l.Error("Failed to list projects: %v", err)
+			httpError(w, fmt.Sprintf("project %q does not exist", projectName), http.StatusBadRequest)
+		case len(names) == 0:
+			httpError(w, fmt.Sprintf("project %q does not exist, no projects are created for the user", projectName), http.StatusBadRequest)
+		default:
+			httpError(w, fmt.Sprintf("project %q does not exist, valid projects: %s", projectName, strings.Join(names, ", ")), http.StatusBadRequest)
+		}
+		return
+	}
+	if errors.Is(err, errTooManyProjects) {
+		l.Error("Too many projects, not creating project %q", projectName)
+		httpError(w, fmt.Sprintf("project %q does not exist and the limit of %d projects per user is reached", projectName, s.maxProjectsPerUser), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		l.Error("Failed to get project ID for project %q: %v", projectName, err)
+		httpError(w, "failed to find project", http.StatusInternalServerError)
+		return
+	}
+	l.projectName, l.projectID = projectName, projectID
+
+	usageTag := r.Header.Get("X-Usage-Tag")
+	if len(usageTag) > maxUsageTagLength {
+		l.Error("Usage tag of %d bytes is too long", len(usageTag))
+		httpError(w, fmt.Sprintf("X-Usage-Tag must not be longer than %d bytes", maxUsageTagLength), http.StatusBadRequest)
+		return
+	}
+
+	// Streaming clients may ask for the usage counted by the proxy in an
+	// extra event at the end of the stream. Other responses carry usage
+	// themselves, so the header is ignored for them.
+	var sendUsage bool
+	if v := r.Header.Get("X-Proxy-Usage-Event"); v != "" {
+		if sendUsage, err = strconv.ParseBool(v); err != nil {
+			l.Error("Invalid X-Proxy-Usage-Event header %q", v)
+			httpError(w, "X-Proxy-Usage-Event must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Test traffic, e.g. of load tests, is recorded but left out of
+	// reports by default.
+	var testTraffic bool
+	if v := r.Header.Get("X-Test"); v != "" {
+		if testTraffic, err = strconv.ParseBool(v); err != nil {
+			l.Error("Invalid X-Test header %q", v)
+			httpError(w, "X-Test must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	if testTraffic && !s.testUsers[userName] && !s.fromTrustedProxy(r) {
+		l.Error("X-Test from a user not in --test-users")
+		httpError(w, "X-Test is only allowed for test users", http.StatusForbidden)
+		return
+	}
+
+	requestBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		l.Error("Failed to read request body: %v", err)
+		httpError(w, "failed to read request body", http.StatusInternalServerError)
+		return
+	}
+
+	crb, tk, ok := parseRequestBody(w, l, r, requestBody)
+	if !ok {
+		return
+	}
+
+	// Retries must repeat the request that used the key, otherwise a
+	// constant key would make all but the first request free.
+	idempotencyKey := r.Header.Get("X-Idempotency-Key")
+	var reqHash string
+	if idempotencyKey != "" {
+		reqHash = requestHash(crb.Model, requestBody)
+		recordedHash, found, err := getIdempotencyKeyHash(conn, projectID, idempotencyKey, s.idempotencyTTL)
+		if err != nil {
+			l.Error("Failed to check idempotency key: %v", err)
+			httpError(w, "failed to check idempotency key", http.StatusInternalServerError)
+			return
+		}
+		if found && recordedHash != "" && recordedHash != reqHash {
+			l.Error("Idempotency key %q reused for a different request", idempotencyKey)
+			httpError(w, "X-Idempotency-Key was already used for a different request", http.StatusConflict)
+			return
+		}
+	}
+
+	modelID, err := getModelID(conn, crb.Model)
+	if err != nil {
+		l.Error("Failed to get model ID for model %q: %v", crb.Model, err)
+		httpError(w, "failed to get model "+crb.Model, http.StatusInternalServerError)
+		return
+	}
+	l.model, l.modelID = crb.Model, modelID
+
+	allowed, err := projectModelAllowed(conn, projectID, modelID)
+	if err != nil {
+		l.Error("Failed to check project models: %v", err)
+		httpError(w, "failed to check project models", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		l.Error("Model is not allowed for the project")
+		httpError(w, fmt.Sprintf("model %s is not allowed for project %s", crb.Model, projectName), http.StatusForbidden)
+		return
+	}
+
+	if s.maxTokensPerRequest != 0 && crb.maxTokens() > s.maxTokensPerRequest {
+		l.Error("Too many tokens requested: max_tokens %d > %d", crb.maxTokens(), s.maxTokensPerRequest)
+		httpError(w, fmt.Sprintf("max_tokens %d exceeds the limit of %d", crb.maxTokens(), s.maxTokensPerRequest), http.StatusBadRequest)
+		return
+	}
+
+	if s.maxPromptTokens != 0 && tk != nil {
+		nTokens, err := countPromptTokens(tk, crb)
+		if err != nil {
+			l.Error("Failed to tokenize prompt: %v", err)
+			httpError(w, "failed to tokenize prompt", http.StatusBadRequest)
+			return
+		}
+		if nTokens > s.maxPromptTokens {
+			l.Error("Prompt too long: %d tokens > %d", nTokens, s.maxPromptTokens)
+			httpError(w, fmt.Sprintf("prompt of %d tokens exceeds the limit of %d", nTokens, s.maxPromptTokens), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s.forceMaxTokens != 0 && r.URL.Path != transcriptionsPath {
+		// max_tokens is rejected by reasoning models, so it is only
+		// capped if the client uses it, never added.
+		field := "max_completion_tokens"
+		switch {
+		case r.URL.Path == responsesPath:
+			field = "max_output_tokens"
+		case crb.MaxTokens != 0 && crb.MaxCompletionTokens == 0:
+			field = "max_tokens"
+		}
+		var prev int
+		var capped bool
+		requestBody, prev, capped, err = capMaxTokens(requestBody, field, s.forceMaxTokens)
+		if err != nil {
+			l.Error("Failed to cap %s: %v", field, err)
+			httpError(w, fmt.Sprintf("failed to cap %s: %v", field, err), http.StatusBadRequest)
+			return
+		}
+		if capped && prev == 0 {
+			l.Info("Set missing %s to %d", field, s.forceMaxTokens)
+		} else if capped {
+			l.Info("Capped %s %d to %d", field, prev, s.forceMaxTokens)
+		}
+	}
+
+	// Limits are only applied once the request is known to be valid, so
+	// that rejected requests don't use them up.
+	userRPM, userTPM, err := getUserLimits(conn, userID, s.rateLimitRPM, s.rateLimitTPM)
+	if err != nil {
+		l.Error("Failed to get user limits: %v", err)
+		httpError(w, "Failed to find user", http.StatusInternalServerError)
+		return
+	}
+	userLimiterKey := "user:" + tenantName + "/" + strconv.FormatInt(userID, 10)
+	if limit, ok := s.limiter.allow(userLimiterKey, userRPM, userTPM); !ok {
+		l.Error("User %s limit exceeded", limit.name)
+		apiError(w, http.StatusTooManyRequests, limit.errorType, "rate_limit_exceeded", fmt.Sprintf("user %s limit exceeded", limit.name))
+		return
+	}
+
+	rpmLimit, tpmLimit, err := getModelLimits(conn, modelID)
+	if err != nil {
+		l.Error("Failed to get model limits: %v", err)
+		httpError(w, "failed to get model "+crb.Model, http.StatusInternalServerError)
+		return
+	}
+	modelLimiterKey := "model:" + tenantName + "/" + crb.Model
+	if limit, ok := s.limiter.allow(modelLimiterKey, rpmLimit, tpmLimit); !ok {
+		l.Error("Model %s limit exceeded", limit.name)
+		apiError(w, http.StatusTooManyRequests, limit.errorType, "rate_limit_exceeded", fmt.Sprintf("model %s %s limit exceeded", crb.Model, limit.name))
+		return
+	}
+
+	var storedBody []byte
+	if s.storeRequestBodies {
+		storedBody = requestBody
+		if s.maxStoredBodySize != 0 && len(storedBody) > s.maxStoredBodySize {
+			storedBody = storedBody[:s.maxStoredBodySize]
+		}
+	}
+
+	l.Info("Proxying")
+
+	resp, err := s.doUpstream(upstreamCtx, l, r, requestBody, upstreamKey)
+
+	// Network failures, timeouts etc.
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+		}
+		l.Error("Failed to proxy request: %v", err)
+		httpError(w, fmt.Sprintf("Failed to read response from OpenAI: %v", err), status)
+		if err := saveRequest(conn, modelID, projectID, status, storedBody); err != nil {
+			l.Error("Failed to save request: %v", err)
+		}
+		return
+	}
+
+	if err := saveRequest(conn, modelID, projectID, resp.StatusCode, storedBody); err != nil {
+		l.Error("Failed to save request: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	// Passthrough keys are limited by their own accounts
+	if limits, ok := parseUpstreamRateLimits(resp.Header); ok && upstreamKey == s.openaiKey {
+		l.Info("Upstream remaining: %d of %d requests, %d of %d tokens", limits.RemainingRequests, limits.LimitRequests, limits.RemainingTokens, limits.LimitTokens)
+		s.upstreamLimits.Store(&limits)
+	}
+
+	h := w.Header()
+	copyUpstreamHeaders(h, resp.Header)
+
+	if resp.StatusCode != http.StatusOK {
+		w.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			l.Error("Failed to write response body: %v", err)
+		}
+
+		l.Info("Error response sent. %s", resp.Status)
+		return
+	}
+
+	// Successful responses are re-framed: streamed ones are chunked and
+	// plain ones get Content-Length of the bytes actually written.
+	h.Del("Content-Length")
+
+	var ru requestUsage
+	switch {
+	case r.URL.Path == transcriptionsPath:
+		ru = proxyTranscriptionResponse(w, l, resp, s.maxResponseSize)
+	case crb.Stream && r.URL.Path == responsesPath:
+		ru = proxyResponsesSSEResponse(w, l, resp, crb, tk, s.maxStreamDuration, s.flushPerEvent, sendUsage)
+	case crb.Stream:
+		ru = proxySSEResponse(w, l, resp, crb, tk, s.maxStreamDuration, s.flushPerEvent, sendUsage)
+	default:
+		ru = proxyPlainResponse(w, l, resp, crb, tk, s.maxResponseSize, acceptsGzip(r), s.storeTokenEstimates)
+	}
+	nTokens := ru.tokens
+	if nTokens != 0 && nTokens < s.minTokensPerRequest && r.URL.Path != transcriptionsPath {
+		l.Info("Used %d tokens, recording minimum %d", nTokens, s.minTokensPerRequest)
+		nTokens = s.minTokensPerRequest
+	}
+	u := usageRecord{
+		modelID:      modelID,
+		projectID:    projectID,
+		tokens:       nTokens,
+		promptTokens: ru.promptTokens,
+		cachedTokens: ru.cachedTokens,
+		streamed:     crb.Stream,
+		tag:          usageTag,
+		test:         testTraffic,
+		passthrough:  passthrough,
+		audioSeconds: ru.audioSeconds,
+	}
+	if s.storePromptHashes {
+		u.promptHash = promptHash(crb)
+	}
+	if nTokens != ru.tokens {
+		u.floorTokens = nTokens - ru.tokens
+	}
+	if ru.estimatedTokens != 0 {
+		// The upstream count, before any --min-tokens-per-request floor
+		u.estimatedTokens, u.reportedTokens = ru.estimatedTokens, ru.tokens
+	}
+	switch {
+	case nTokens == 0 && u.audioSeconds == 0:
+		// Handlers return 0 when nothing was generated, which is not charged
+	case idempotencyKey != "":
+		saved, err := saveUsageOnce(conn, idempotencyKey, reqHash, s.idempotencyTTL, u, s.usageGranularity)
+		if err != nil {
+			l.Error("Failed to save usage, tokens %d: %v", nTokens, err)
+		} else if !saved {
+			l.Info("Retry with idempotency key %q, not saving usage", idempotencyKey)
+		} else {
+			s.tokens.Add(int64(nTokens))
+			s.streamUsage(l, u)
+		}
+	default:
+		if err := saveUsage(conn, u, s.usageGranularity); err != nil {
+			l.Error("Failed to save usage, tokens %d: %v", nTokens, err)
+		} else {
+			s.tokens.Add(int64(nTokens))
+			s.streamUsage(l, u)
+		}
+	}
+	s.limiter.addTokens(modelLimiterKey, nTokens)
+	s.limiter.addTokens(userLimiterKey, nTokens)
+}
+
+// usageEvent is a line of the usage stream.
+type usageEvent struct {
+	TS           time.Time `json:"ts"`
+	RequestID    string    `json:"request_id"`
+	Tenant       string    `json:"tenant,omitempty"`
+	User         string    `json:"user"`
+	Project      string    `json:"project"`
+	Model        string    `json:"model"`
+	Tokens       int       `json:"tokens"`
+	CachedTokens int       `json:"cached_tokens"`
+	AudioSeconds int       `json:"audio_seconds,omitempty"`
+	Streamed     bool      `json:"streamed"`
+	Tag          string    `json:"tag,omitempty"`
+	Test         bool      `json:"test,omitempty"`
+}
+
+// streamUsage writes the saved usage of a request to the usage stream, if
+// there is one.
+func (s *server) streamUsage(l *reqLogger, u usageRecord) {
+	if s.usageStream == nil {
+		return
+	}
+	b, err := json.Marshal(usageEvent{
+		TS:           time.Now().UTC(),
+		RequestID:    l.requestID,
+		Tenant:       l.tenant,
+		User:         l.userName,
+		Project:      l.projectName,
+		Model:        l.model,
+		Tokens:       u.tokens,
+		CachedTokens: u.cachedTokens,
+		AudioSeconds: u.audioSeconds,
+		Streamed:     u.streamed,
+		Tag:          u.tag,
+		Test:         u.test,
+	})
+	if err != nil {
+		l.Error("Failed to encode usage event: %v", err)
+		return
+	}
+
+	s.usageStreamMu.Lock()
+	defer s.usageStreamMu.Unlock()
+	if _, err := s.usageStream.Write(append(b, '\n')); err != nil {
+		l.Error("Failed to write usage event: %v", err)
+	}
+}
+
+// Chat completions for the project in the rest of the path, for clients
+// that can't set X-Project
+const projectPathPrefix = "/v1/chat/completions/p/"
+
+// proxyProjectPathRequest proxies a request to
+// /v1/chat/completions/p/<project> as one to /v1/chat/completions with
+// the X-Project header set to the project.
+func (s *server) proxyProjectPathRequest(w http.ResponseWriter, r *http.Request) {
+	l := newReqLogger(r)
+
+	projectName := strings.TrimPrefix(r.URL.Path, projectPathPrefix)
+	if projectName == "" {
+		l.Error("Empty project in path")
+		httpError(w, "project is missing in path", http.StatusBadRequest)
+		return
+	}
+	if h := r.Header.Get("X-Project"); h != "" && h != projectName {
+		l.Error("Project %q in path conflicts with X-Project %q", projectName, h)
+		httpError(w, "project in path does not match X-Project", http.StatusBadRequest)
+		return
+	}
+
+	r = r.Clone(r.Context())
+	r.URL.Path, r.URL.RawPath = "/v1/chat/completions", ""
+	r.Header.Set("X-Project", projectName)
+	s.proxyRequest(w, r)
+}
+
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// status reports the vitals of this process.
+func (s *server) status(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		UptimeSeconds int64 `json:"uptime_seconds"`
+		Requests      int64 `json:"requests"`
+		Tokens        int64 `json:"tokens"`
+		InFlight      int64 `json:"in_flight"`
+		Draining      bool  `json:"draining"`
+		// Omitted until the first upstream response with rate limits
+		UpstreamRateLimits *upstreamRateLimits `json:"upstream_rate_limits,omitempty"`
+	}{
+		UptimeSeconds: int64(time.Since(s.started) / time.Second),
+		Requests:      s.requests.Load(),
+		Tokens:        s.tokens.Load(),
+		InFlight:      s.inFlight.Load(),
+		Draining:      s.draining.Load(),
+
+		UpstreamRateLimits: s.upstreamLimits.Load(),
+	}); err != nil {
+		logError(r, "Failed to write status: %v", err)
+	}
+}
+
+func (s *server) corsOriginAllowed(origin string) bool {
+	for _, o := range s.corsOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// cors adds CORS headers for allowed origins and answers preflight requests.
+func (s *server) cors(next http.Handler) http.Handler {
+	if len(s.corsOrigins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !s.corsOriginAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+			h.Set("Access-Control-Allow-Headers", reqHeaders)
+		}
+		h.Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// newServer returns the proxy of cfg. pools maps tenant names to their
+// databases, the default tenant's name is empty.
+func newServer(pools map[string]*sqlitemigration.Pool, cfg serverConfig) *server {
+	s := &server{
+		serverConfig: cfg,
+		pools:        pools,
+		client:       &http.Client{Transport: cfg.upstreamTransport},
+		limiter:      newRateLimiter(),
+		started:      time.Now(),
+	}
+	if cfg.userCacheSize != 0 {
+		s.userCache = newUserCache(cfg.userCacheSize, cfg.userCacheTTL)
+	}
+	return s
+}
+
+// handler returns the handler of the proxied API, /healthz and /status.
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", s.proxyRequest)
+	mux.HandleFunc(projectPathPrefix, s.proxyProjectPathRequest)
+	mux.HandleFunc(responsesPath, s.proxyRequest)
+	mux.HandleFunc(transcriptionsPath, s.proxyRequest)
+	mux.HandleFunc(debugRoutePath, s.debugRoute)
+	mux.HandleFunc(s.adminPathPrefix+"/healthz", s.healthz)
+	mux.HandleFunc(s.adminPathPrefix+"/status", s.status)
+	return s.cors(mux)
+}
+
+// serve runs the proxy. pools maps tenant names to their databases, the
+// default tenant's name is empty.
+func serve(pools map[string]*sqlitemigration.Pool, listenURL string, cfg serverConfig) {
+	s := newServer(pools, cfg)
+
+	if err := checkTokenizer(); err != nil {
+		log.Fatalf("Tokenizer is unavailable: %v", err)
+	}
+
+	httpServers := []*http.Server{{Addr: listenURL, Handler: s.handler()}}
+
+	if s.adminListenURL != "" {
+		if s.adminToken == "" {
+			log.Fatalf("admin API requires an admin token")
+		}
+		httpServers = append(httpServers, &http.Server{Addr: s.adminListenURL, Handler: s.adminHandler()})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, len(httpServers))
+	for _, httpServer := range httpServers {
+		httpServer := httpServer
+		go func() {
+			if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+				errCh <- fmt.Errorf("failed to listen on %s: %w", httpServer.Addr, err)
+			}
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	shutdown(httpServers, pools)
+}
+
+// shutdown stops the servers, waiting for their in-flight requests to
+// finish, and checkpoints the WAL of every tenant database.
+func shutdown(httpServers []*http.Server, pools map[string]*sqlitemigration.Pool) {
+	log.Printf("Shutting down, waiting for in-flight requests to finish")
+
+	// Usage is saved by request handlers before they return, so once
+	// Shutdown returns all accounted usage has been written.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	for _, httpServer := range httpServers {
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down %s gracefully: %v", httpServer.Addr, err)
+		}
+	}
+
+	for tenantName, pool := range pools {
+		conn, err := pool.Get(context.Background())
+		if err != nil {
+			log.Printf("Failed to get database connection for checkpoint of tenant %q: %v", tenantName, err)
+			continue
+		}
+		if err := checkpointWAL(conn); err != nil {
+			log.Printf("Failed to checkpoint database of tenant %q: %v", tenantName, err)
+		}
+		pool.Put(conn)
 	}
 }
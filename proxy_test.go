@@ -0,0 +1,939 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiktoken-go/tokenizer"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const testCompletion = `{"choices":[{"message":{"content":"Hello!"}}],"usage":{"prompt_tokens":7,"completion_tokens":3,"total_tokens":10}}`
+
+// newTestUpstream starts an upstream answering every request with h.
+func newTestUpstream(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(h)
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// completionUpstream answers every request with testCompletion.
+func completionUpstream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, testCompletion)
+}
+
+// testServerConfig is the configuration of serve with default flags,
+// proxying to upstreamURL.
+func testServerConfig(upstreamURL string) serverConfig {
+	return serverConfig{
+		openaiKey:            "upstream-key",
+		upstreamURL:          upstreamURL,
+		upstreamPathPrefix:   "/v1",
+		upstreamAuthHeader:   "Authorization",
+		upstreamAuthFormat:   "Bearer {key}",
+		maxProjectNameLength: 100,
+		forwardHeaders:       []string{"Content-Type", "Accept"},
+		idempotencyTTL:       24 * time.Hour,
+	}
+}
+
+// newTestProxy starts the proxy of cfg with a temporary database.
+func newTestProxy(t *testing.T, cfg serverConfig) (*server, *httptest.Server, *sqlitemigration.Pool) {
+	t.Helper()
+	pool := newTestPool(t)
+	s := newServer(map[string]*sqlitemigration.Pool{"": pool}, cfg)
+	proxy := httptest.NewServer(s.handler())
+	t.Cleanup(proxy.Close)
+	return s, proxy, pool
+}
+
+// postJSON sends body to the url with the key and returns the response
+// status and body.
+func postJSON(t *testing.T, url, key, body string) (int, string) {
+	t.Helper()
+	return postJSONWithHeaders(t, url, key, nil, body)
+}
+
+// postJSONWithHeaders is postJSON with extra request headers.
+func postJSONWithHeaders(t *testing.T, url, key string, header map[string]string, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+	for name, v := range header {
+		req.Header.Set(name, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+const (
+	testChatRequest   = `{"model":"gpt-4","messages":[{"role":"user","content":"Hi"}]}`
+	testStreamRequest = `{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"Hi"}]}`
+)
+
+func TestDeletedUserCannotAuthenticate(t *testing.T) {
+	tests := []struct {
+		name          string
+		userCacheSize int
+		deleteUser    func(t *testing.T, s *server, pool *sqlitemigration.Pool)
+	}{
+		{
+			name: "deleted in the database",
+			deleteUser: func(t *testing.T, s *server, pool *sqlitemigration.Pool) {
+				if _, err := softDeleteUser(getTestConn(t, pool), "alice"); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:          "deleted through the admin API with the user cache",
+			userCacheSize: 10,
+			deleteUser: func(t *testing.T, s *server, pool *sqlitemigration.Pool) {
+				admin := httptest.NewServer(s.adminHandler())
+				defer admin.Close()
+				if status, body := postJSON(t, admin.URL+"/admin/delete-user", s.adminToken, `{"name":"alice"}`); status != http.StatusOK {
+					t.Fatalf("delete-user: %d %s", status, body)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testServerConfig(newTestUpstream(t, completionUpstream).URL)
+			cfg.adminToken = "admin-token"
+			cfg.userCacheSize, cfg.userCacheTTL = tt.userCacheSize, time.Hour
+			s, proxy, pool := newTestProxy(t, cfg)
+			if err := setUserKey(getTestConn(t, pool), "alice", "k1", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			if status, body := postJSON(t, proxy.URL+"/v1/chat/completions", "k1", testChatRequest); status != http.StatusOK {
+				t.Fatalf("before deletion: got %d %s, want 200", status, body)
+			}
+
+			tt.deleteUser(t, s, pool)
+
+			if status, body := postJSON(t, proxy.URL+"/v1/chat/completions", "k1", testChatRequest); status != http.StatusUnauthorized {
+				t.Errorf("after deletion: got %d %s, want 401", status, body)
+			}
+			_, _, _, found, err := findUserByKey(getTestConn(t, pool), "k1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found {
+				t.Error("findUserByKey found the deleted user")
+			}
+		})
+	}
+}
+
+// sseUpstream streams the events, then ends the response if drop is not
+// set, or drops the connection mid-response.
+func sseUpstream(events []string, drop bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			io.WriteString(w, "data: "+event+"\n\n")
+		}
+		w.(http.Flusher).Flush()
+		if drop {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		}
+	}
+}
+
+// testUsageTotals returns the tokens and prompt tokens of all usage.
+func testUsageTotals(t *testing.T, pool *sqlitemigration.Pool) (tokens, promptTokens int) {
+	t.Helper()
+	if err := sqlitex.ExecuteTransient(getTestConn(t, pool), "SELECT IFNULL(SUM(tokens), 0) AS tokens, IFNULL(SUM(prompt_tokens), 0) AS promptTokens FROM usage", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			tokens, promptTokens = int(stmt.GetInt64("tokens")), int(stmt.GetInt64("promptTokens"))
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return tokens, promptTokens
+}
+
+func TestSSEUpstreamClosesEarly(t *testing.T) {
+	const (
+		hello  = `{"choices":[{"delta":{"content":"Hello"}}]}`
+		there  = `{"choices":[{"delta":{"content":" there"}}]}`
+		usage  = `{"choices":[],"usage":{"prompt_tokens":7,"completion_tokens":3,"total_tokens":10}}`
+		broken = `{"choices":[{"delta":`
+	)
+	// The estimate of a stream without usage: the one token of the
+	// prompt "Hi" of testStreamRequest, and the two of "Hello there".
+	const estimatedPrompt, estimatedTokens = 1, 3
+
+	tests := []struct {
+		name   string
+		events []string
+		drop   bool
+		// Usage recorded
+		tokens, promptTokens int
+	}{
+		{"done", []string{hello, there, "[DONE]"}, false, estimatedTokens, estimatedPrompt},
+		{"closed without done", []string{hello, there}, false, estimatedTokens, estimatedPrompt},
+		{"dropped without done", []string{hello, there}, true, estimatedTokens, estimatedPrompt},
+		{"dropped after usage", []string{hello, there, usage}, true, 10, 7},
+		{"dropped after an incomplete message", []string{hello, there, broken}, true, estimatedTokens, estimatedPrompt},
+		{"dropped before any delta", nil, true, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, proxy, pool := newTestProxy(t, testServerConfig(newTestUpstream(t, sseUpstream(tt.events, tt.drop)).URL))
+			if err := setUserKey(getTestConn(t, pool), "alice", "k1", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			// postJSON fails the test if the client stream is cut off
+			status, body := postJSON(t, proxy.URL+"/v1/chat/completions", "k1", testStreamRequest)
+			if status != http.StatusOK {
+				t.Fatalf("got %d %s, want 200", status, body)
+			}
+			if len(tt.events) != 0 && !strings.Contains(body, "data: "+hello+"\n\n") {
+				t.Errorf("stream does not contain the first delta: %q", body)
+			}
+			if strings.Contains(body, `"error"`) {
+				t.Errorf("stream ends with an error: %q", body)
+			}
+
+			tokens, promptTokens := testUsageTotals(t, pool)
+			if tokens != tt.tokens || promptTokens != tt.promptTokens {
+				t.Errorf("recorded %d tokens, %d prompt tokens, want %d, %d", tokens, promptTokens, tt.tokens, tt.promptTokens)
+			}
+		})
+	}
+}
+
+// testSSEStream is an upstream stream of n content deltas ending with
+// [DONE].
+func testSSEStream(n int) []byte {
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "data: {\"choices\":[{\"delta\":{\"content\":\"word%d \"}}]}\n\n", i)
+	}
+	b.WriteString("data: [DONE]\n\n")
+	return b.Bytes()
+}
+
+// discardLog silences the log for the rest of the benchmark.
+func discardLog(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func BenchmarkSSEFlush(b *testing.B) {
+	discardLog(b)
+	stream := testSSEStream(1000)
+	tk, err := tokenizer.Get(tokenizer.Cl100kBase)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, flushPerEvent := range []bool{false, true} {
+		name := "per line"
+		if flushPerEvent {
+			name = "per event"
+		}
+		b.Run(name, func(b *testing.B) {
+			// The stream goes to a real client, so that flushes cost what
+			// they do in production
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				resp := &http.Response{Body: io.NopCloser(bytes.NewReader(stream))}
+				proxySSEResponse(w, newReqLogger(r), resp, completionRequestBody{}, tk, 0, flushPerEvent, false)
+			}))
+			defer proxy.Close()
+
+			b.SetBytes(int64(len(stream)))
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(proxy.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSSETokenization(b *testing.B) {
+	discardLog(b)
+	tk, err := tokenizer.Get(tokenizer.Cl100kBase)
+	if err != nil {
+		b.Fatal(err)
+	}
+	crb := completionRequestBody{Messages: []struct{ Content string }{{"Hi"}}}
+	const (
+		done  = "data: [DONE]\n\n"
+		usage = `data: {"choices":[],"usage":{"prompt_tokens":7,"completion_tokens":3,"total_tokens":10}}` + "\n\n"
+	)
+
+	for _, n := range []int{10, 100, 1000} {
+		stream := testSSEStream(n)
+		// Without usage the deltas are tokenized, with it they are not
+		streamWithUsage := bytes.Replace(stream, []byte(done), []byte(usage+done), 1)
+		for _, s := range []struct {
+			name   string
+			stream []byte
+		}{
+			{fmt.Sprintf("%d deltas estimated", n), stream},
+			{fmt.Sprintf("%d deltas reported", n), streamWithUsage},
+		} {
+			b.Run(s.name, func(b *testing.B) {
+				r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+				for i := 0; i < b.N; i++ {
+					resp := &http.Response{Body: io.NopCloser(bytes.NewReader(s.stream))}
+					proxySSEResponse(httptest.NewRecorder(), newReqLogger(r), resp, crb, tk, 0, false, false)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkFindUser(b *testing.B) {
+	const users, activeUsers = 1000, 100
+
+	pool := newTestPool(b)
+	conn := getTestConn(b, pool)
+	err := func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+		for i := 0; i < users; i++ {
+			if err := setUserKey(conn, fmt.Sprintf("user%d", i), fmt.Sprintf("key%d", i), ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, cacheSize := range []int{0, activeUsers} {
+		name := "database"
+		if cacheSize != 0 {
+			name = "cache"
+		}
+		b.Run(name, func(b *testing.B) {
+			cfg := testServerConfig("")
+			cfg.userCacheSize, cfg.userCacheTTL = cacheSize, time.Hour
+			s := newServer(map[string]*sqlitemigration.Pool{"": pool}, cfg)
+			for i := 0; i < b.N; i++ {
+				if _, _, _, found, err := s.findUser(conn, "", fmt.Sprintf("key%d", i%activeUsers)); err != nil || !found {
+					b.Fatalf("found %v, error %v", found, err)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	const inFlight = 5
+
+	tests := []struct {
+		name     string
+		request  string
+		response []byte
+	}{
+		{"completions", testChatRequest, []byte(testCompletion)},
+		{"streamed completions", testStreamRequest, testSSEStream(3)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The upstream holds the requests until released, so that they
+			// are in flight when the shutdown starts
+			arrived, release := make(chan struct{}, inFlight), make(chan struct{})
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				arrived <- struct{}{}
+				<-release
+				w.Write(tt.response)
+			})
+
+			path := filepath.Join(t.TempDir(), "test.db")
+			pool, err := newPool(dbOptions{path: path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pools := map[string]*sqlitemigration.Pool{"": pool}
+			conn, err := pool.Get(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = setUserKey(conn, "alice", "k1", "")
+			pool.Put(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			httpServer := &http.Server{Handler: newServer(pools, testServerConfig(upstream.URL)).handler()}
+			go httpServer.Serve(ln)
+
+			statuses := make(chan int, inFlight)
+			for i := 0; i < inFlight; i++ {
+				req, err := http.NewRequest(http.MethodPost, "http://"+ln.Addr().String()+"/v1/chat/completions", strings.NewReader(tt.request))
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Authorization", "Bearer k1")
+				go func() {
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						statuses <- 0
+						return
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					statuses <- resp.StatusCode
+				}()
+			}
+			for i := 0; i < inFlight; i++ {
+				<-arrived
+			}
+
+			done := make(chan struct{})
+			go func() {
+				shutdown([]*http.Server{httpServer}, pools)
+				close(done)
+			}()
+			select {
+			case <-done:
+				t.Fatal("shutdown returned with requests in flight")
+			case <-time.After(100 * time.Millisecond):
+			}
+			close(release)
+			<-done
+
+			for i := 0; i < inFlight; i++ {
+				if status := <-statuses; status != http.StatusOK {
+					t.Errorf("got status %d, want 200", status)
+				}
+			}
+			if fi, err := os.Stat(path + "-wal"); err == nil && fi.Size() != 0 {
+				t.Errorf("WAL has %d bytes after shutdown, want it checkpointed", fi.Size())
+			}
+			if err := pool.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened := newTestPoolAt(t, path)
+			var requests int
+			if err := sqlitex.ExecuteTransient(getTestConn(t, reopened), "SELECT IFNULL(SUM(requests), 0) AS requests FROM usage", &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					requests = int(stmt.GetInt64("requests"))
+					return nil
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if requests != inFlight {
+				t.Errorf("usage of %d requests persisted, want %d", requests, inFlight)
+			}
+		})
+	}
+}
+
+func TestStructuredOutput(t *testing.T) {
+	const responseFormat = `"response_format":{"type":"json_schema","json_schema":{"name":"answer","strict":true,"schema":{"type":"object","properties":{"answer":{"type":"string"}},"required":["answer"],"additionalProperties":false}}}`
+	// The JSON content {"answer":"Hello"} is streamed in pieces
+	var stream bytes.Buffer
+	for _, piece := range []string{`{\"`, `answer`, `\":\"`, `Hello`, `\"}`} {
+		fmt.Fprintf(&stream, "data: {\"choices\":[{\"delta\":{\"content\":\"%s\"}}]}\n\n", piece)
+	}
+	stream.WriteString("data: [DONE]\n\n")
+
+	tests := []struct {
+		name     string
+		request  string
+		response []byte
+		// Usage recorded
+		tokens, promptTokens int
+	}{
+		{
+			name:     "completion",
+			request:  `{"model":"gpt-4",` + responseFormat + `,"messages":[{"role":"user","content":"Hi"}]}`,
+			response: []byte(`{"choices":[{"message":{"content":"{\"answer\":\"Hello\"}"}}],"usage":{"prompt_tokens":7,"completion_tokens":5,"total_tokens":12}}`),
+			tokens:   12, promptTokens: 7,
+		},
+		{
+			name:     "streamed",
+			request:  `{"model":"gpt-4","stream":true,` + responseFormat + `,"messages":[{"role":"user","content":"Hi"}]}`,
+			response: stream.Bytes(),
+			// The one token of "Hi" and the five of {"answer":"Hello"}
+			tokens: 6, promptTokens: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded []byte
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				forwarded, _ = io.ReadAll(r.Body)
+				w.Write(tt.response)
+			})
+			_, proxy, pool := newTestProxy(t, testServerConfig(upstream.URL))
+			if err := setUserKey(getTestConn(t, pool), "alice", "k1", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			status, body := postJSON(t, proxy.URL+"/v1/chat/completions", "k1", tt.request)
+			if status != http.StatusOK {
+				t.Fatalf("got %d %s, want 200", status, body)
+			}
+			if body != string(tt.response) {
+				t.Errorf("got response %s, want the upstream response verbatim", body)
+			}
+			if string(forwarded) != tt.request {
+				t.Errorf("forwarded %s, want the request verbatim", forwarded)
+			}
+			tokens, promptTokens := testUsageTotals(t, pool)
+			if tokens != tt.tokens || promptTokens != tt.promptTokens {
+				t.Errorf("recorded %d tokens, %d prompt tokens, want %d, %d", tokens, promptTokens, tt.tokens, tt.promptTokens)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	const samples = 1000
+
+	tests := []struct {
+		attempt    int
+		maxBackoff time.Duration
+		// Delays are in [0, bound)
+		bound time.Duration
+	}{
+		{0, 10 * time.Second, 500 * time.Millisecond},
+		{1, 10 * time.Second, time.Second},
+		{3, 10 * time.Second, 4 * time.Second},
+		{4, 10 * time.Second, 8 * time.Second},
+		{5, 10 * time.Second, 10 * time.Second},
+		{40, 10 * time.Second, 10 * time.Second},
+		{0, 100 * time.Millisecond, 100 * time.Millisecond},
+		{3, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("attempt %d max %s", tt.attempt, tt.maxBackoff), func(t *testing.T) {
+			var longest time.Duration
+			seen := map[time.Duration]bool{}
+			for i := 0; i < samples; i++ {
+				d := retryBackoff(tt.attempt, tt.maxBackoff)
+				if d < 0 || (d != 0 && d >= tt.bound) {
+					t.Fatalf("got %s, want it in [0, %s)", d, tt.bound)
+				}
+				if d > longest {
+					longest = d
+				}
+				seen[d] = true
+			}
+			if tt.bound == 0 {
+				return
+			}
+			// With full jitter the delays spread over the whole range
+			if longest < tt.bound/2 {
+				t.Errorf("longest of %d delays is %s, want delays up to %s", samples, longest, tt.bound)
+			}
+			if len(seen) < samples/2 {
+				t.Errorf("got %d distinct delays of %d, want them jittered", len(seen), samples)
+			}
+		})
+	}
+}
+
+func TestTestTrafficHeader(t *testing.T) {
+	tests := []struct {
+		name           string
+		user           string
+		trustedProxies string
+		xTest          string
+		status         int
+		// Usage recorded as test traffic and as other usage
+		testTokens, tokens int
+	}{
+		{"test user", "tester", "", "true", http.StatusOK, 10, 0},
+		{"test user without X-Test", "tester", "", "", http.StatusOK, 0, 10},
+		{"other user", "alice", "", "true", http.StatusForbidden, 0, 0},
+		{"other user with X-Test false", "alice", "", "false", http.StatusOK, 0, 10},
+		{"other user from a trusted proxy", "alice", "127.0.0.1/32", "true", http.StatusOK, 10, 0},
+		{"other user from an untrusted proxy", "alice", "10.0.0.0/8", "true", http.StatusForbidden, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testServerConfig(newTestUpstream(t, completionUpstream).URL)
+			cfg.testUsers = map[string]bool{"tester": true}
+			if tt.trustedProxies != "" {
+				trustedProxies, err := parseTrustedProxies([]string{tt.trustedProxies})
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg.trustedAuthHeader, cfg.trustedProxies = "X-Authenticated-User", trustedProxies
+			}
+			_, proxy, pool := newTestProxy(t, cfg)
+			conn := getTestConn(t, pool)
+			if err := setUserKey(conn, tt.user, "k1", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			var header map[string]string
+			if tt.xTest != "" {
+				header = map[string]string{"X-Test": tt.xTest}
+			}
+			if status, body := postJSONWithHeaders(t, proxy.URL+"/v1/chat/completions", "k1", header, testChatRequest); status != tt.status {
+				t.Fatalf("got %d %s, want %d", status, body, tt.status)
+			}
+
+			var testTokens, tokens int
+			if err := sqlitex.ExecuteTransient(conn, "SELECT test, SUM(tokens) AS tokens FROM usage GROUP BY test", &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					if stmt.GetBool("test") {
+						testTokens = int(stmt.GetInt64("tokens"))
+					} else {
+						tokens = int(stmt.GetInt64("tokens"))
+					}
+					return nil
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if testTokens != tt.testTokens || tokens != tt.tokens {
+				t.Errorf("recorded %d test tokens and %d other tokens, want %d and %d", testTokens, tokens, tt.testTokens, tt.tokens)
+			}
+		})
+	}
+}
+
+// transcriptionRequest is a multipart transcription request of model in
+// format ("" for the default).
+func transcriptionRequest(t *testing.T, model, format string) (contentType, body string) {
+	t.Helper()
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fields := [][2]string{{"model", model}}
+	if format != "" {
+		fields = append(fields, [2]string{"response_format", format})
+	}
+	for _, f := range fields {
+		if err := mw.WriteField(f[0], f[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := mw.CreateFormFile("file", "audio.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, "audio")
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return mw.FormDataContentType(), b.String()
+}
+
+func TestTranscriptionUsage(t *testing.T) {
+	tests := []struct {
+		name     string
+		model    string
+		format   string
+		response string
+		status   int
+		// Usage recorded
+		tokens, audioSeconds int
+	}{
+		{"billed by duration", "whisper-1", "json", `{"text":"Hi","usage":{"type":"duration","seconds":59.2}}`, http.StatusOK, 0, 60},
+		{"billed by duration, verbose", "whisper-1", "verbose_json", `{"text":"Hi","duration":12.5}`, http.StatusOK, 0, 13},
+		{"billed by tokens", "gpt-4o-transcribe", "", `{"text":"Hi","usage":{"type":"tokens","input_tokens":20,"output_tokens":5,"total_tokens":25}}`, http.StatusOK, 25, 0},
+		{"text", "whisper-1", "text", "Hi", http.StatusBadRequest, 0, 0},
+		{"srt", "whisper-1", "srt", "1\n00:00:00,000 --> 00:00:01,000\nHi\n", http.StatusBadRequest, 0, 0},
+		{"vtt", "whisper-1", "vtt", "WEBVTT\n", http.StatusBadRequest, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var proxied bool
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				proxied = true
+				io.WriteString(w, tt.response)
+			})
+			_, proxy, pool := newTestProxy(t, testServerConfig(upstream.URL))
+			conn := getTestConn(t, pool)
+			if err := setUserKey(conn, "alice", "k1", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			contentType, body := transcriptionRequest(t, tt.model, tt.format)
+			status, respBody := postJSONWithHeaders(t, proxy.URL+"/v1/audio/transcriptions", "k1", map[string]string{"Content-Type": contentType}, body)
+			if status != tt.status {
+				t.Fatalf("got %d %s, want %d", status, respBody, tt.status)
+			}
+			if proxied != (tt.status == http.StatusOK) {
+				t.Errorf("proxied %v, want %v", proxied, tt.status == http.StatusOK)
+			}
+
+			var tokens, audioSeconds int
+			if err := sqlitex.ExecuteTransient(conn, "SELECT IFNULL(SUM(tokens), 0) AS tokens, IFNULL(SUM(audio_seconds), 0) AS audioSeconds FROM usage", &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					tokens, audioSeconds = int(stmt.GetInt64("tokens")), int(stmt.GetInt64("audioSeconds"))
+					return nil
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if tokens != tt.tokens || audioSeconds != tt.audioSeconds {
+				t.Errorf("recorded %d tokens, %d seconds, want %d, %d", tokens, audioSeconds, tt.tokens, tt.audioSeconds)
+			}
+		})
+	}
+}
+
+func TestPassthroughOnlyWithoutUpstreamKey(t *testing.T) {
+	tests := []struct {
+		name            string
+		passthroughUser string
+		key             string
+		status          int
+		// Authorization header sent upstream, empty if not proxied
+		upstreamAuth string
+	}{
+		{"passthrough key", "", "sk-client", http.StatusOK, "Bearer sk-client"},
+		{"passthrough key with usage", "shared", "sk-client", http.StatusOK, "Bearer sk-client"},
+		{"proxy key", "", "k1", http.StatusServiceUnavailable, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamAuth string
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				upstreamAuth = r.Header.Get("Authorization")
+				completionUpstream(w, r)
+			})
+			cfg := testServerConfig(upstream.URL)
+			cfg.openaiKey = ""
+			cfg.passthroughKeyPattern = regexp.MustCompile("^sk-")
+			cfg.passthroughUser = tt.passthroughUser
+			_, proxy, pool := newTestProxy(t, cfg)
+			conn := getTestConn(t, pool)
+			if err := setUserKey(conn, "alice", "k1", ""); err != nil {
+				t.Fatal(err)
+			}
+			if err := setUserKey(conn, "shared", "k2", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			if status, body := postJSON(t, proxy.URL+"/v1/chat/completions", tt.key, testChatRequest); status != tt.status {
+				t.Fatalf("got %d %s, want %d", status, body, tt.status)
+			}
+			if upstreamAuth != tt.upstreamAuth {
+				t.Errorf("sent Authorization %q upstream, want %q", upstreamAuth, tt.upstreamAuth)
+			}
+		})
+	}
+}
+
+// decodeJSONFields decodes a JSON object, keeping numbers as they are
+// written.
+func decodeJSONFields(t *testing.T, b []byte) map[string]any {
+	t.Helper()
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var fields map[string]any
+	if err := d.Decode(&fields); err != nil {
+		t.Fatalf("failed to decode %s: %v", b, err)
+	}
+	return fields
+}
+
+func TestRequestBodyRoundTrip(t *testing.T) {
+	// Unusual key order, formatting, numbers beyond float64 precision,
+	// HTML characters and unknown nested fields
+	const fields = `"seed": 1234567890123456789,
+  "logit_bias": {"50256": -100, "198": 2.5e1},
+  "response_format": {"type": "json_schema", "json_schema": {"name": "a", "schema": {"type": "object", "properties": {}}}},
+  "x_vendor": {"list": [1, {"b": null}, "<b>&amp;</b>"], "unicode": "é "},
+  "messages": [{"role": "user", "content": "Hi <there> & bye"}],
+  "model": "gpt-4"`
+
+	tests := []struct {
+		name           string
+		forceMaxTokens int
+		maxTokensField string
+		// Value of max_completion_tokens forwarded, "" to expect the body
+		// byte for byte
+		forwarded string
+	}{
+		{"no capping", 0, `,
+  "max_completion_tokens": 5000`, ""},
+		{"below the cap", 1000, `,
+  "max_completion_tokens": 100`, ""},
+		{"above the cap", 1000, `,
+  "max_completion_tokens": 5000`, "1000"},
+		{"missing", 1000, "", "1000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded []byte
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				forwarded, _ = io.ReadAll(r.Body)
+				completionUpstream(w, r)
+			})
+			cfg := testServerConfig(upstream.URL)
+			cfg.forceMaxTokens = tt.forceMaxTokens
+			_, proxy, pool := newTestProxy(t, cfg)
+			if err := setUserKey(getTestConn(t, pool), "alice", "k1", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			body := "{\n  " + fields + tt.maxTokensField + "\n}"
+			if status, respBody := postJSON(t, proxy.URL+"/v1/chat/completions", "k1", body); status != http.StatusOK {
+				t.Fatalf("got %d %s, want 200", status, respBody)
+			}
+
+			if tt.forwarded == "" {
+				if string(forwarded) != body {
+					t.Errorf("forwarded %s, want the body byte for byte", forwarded)
+				}
+				return
+			}
+			want := decodeJSONFields(t, []byte(body))
+			want["max_completion_tokens"] = json.Number(tt.forwarded)
+			if got := decodeJSONFields(t, forwarded); !reflect.DeepEqual(got, want) {
+				t.Errorf("forwarded %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRejectedRequestsDontUseRateLimit(t *testing.T) {
+	const rpm = 2
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		body   string
+		status int
+	}{
+		{"malformed body", nil, `{"model":`, http.StatusBadRequest},
+		{"unknown model", nil, `{"model":"no-such-model","messages":[]}`, http.StatusBadRequest},
+		{"invalid project", map[string]string{"X-Project": strings.Repeat("p", 101)}, testChatRequest, http.StatusBadRequest},
+		{"invalid header", map[string]string{"X-Proxy-Usage-Event": "maybe"}, testChatRequest, http.StatusBadRequest},
+		{"prompt too long", nil, `{"model":"gpt-4","messages":[{"role":"user","content":"` + strings.Repeat("word ", 100) + `"}]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testServerConfig(newTestUpstream(t, completionUpstream).URL)
+			cfg.rateLimitRPM = rpm
+			cfg.maxPromptTokens = 50
+			_, proxy, pool := newTestProxy(t, cfg)
+			if err := setUserKey(getTestConn(t, pool), "alice", "k1", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2*rpm; i++ {
+				if status, body := postJSONWithHeaders(t, proxy.URL+"/v1/chat/completions", "k1", tt.header, tt.body); status != tt.status {
+					t.Fatalf("rejected request: got %d %s, want %d", status, body, tt.status)
+				}
+			}
+			for i := 0; i < rpm; i++ {
+				if status, body := postJSON(t, proxy.URL+"/v1/chat/completions", "k1", testChatRequest); status != http.StatusOK {
+					t.Fatalf("request %d after the rejected ones: got %d %s, want 200", i+1, status, body)
+				}
+			}
+			if status, _ := postJSON(t, proxy.URL+"/v1/chat/completions", "k1", testChatRequest); status != http.StatusTooManyRequests {
+				t.Errorf("request over the limit: got %d, want 429", status)
+			}
+		})
+	}
+}
+
+func TestProxyUsageEvent(t *testing.T) {
+	const (
+		chatStream = "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\n" +
+			"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":3,\"total_tokens\":10}}\n\n" +
+			"data: [DONE]\n\n"
+		responsesStream = "event: response.output_text.delta\ndata: {\"type\":\"response.output_text.delta\",\"delta\":\"Hello\"}\n\n" +
+			"event: response.completed\ndata: {\"type\":\"response.completed\",\"response\":{\"usage\":{\"input_tokens\":7,\"output_tokens\":3,\"total_tokens\":10}}}\n\n"
+		event = "event: proxy_usage\ndata: {\"prompt_tokens\":7,\"completion_tokens\":3,\"total_tokens\":10,\"estimated\":false}\n\n"
+	)
+
+	tests := []struct {
+		name     string
+		path     string
+		request  string
+		response string
+		header   string
+		// Usage event expected at the end of the response
+		event bool
+	}{
+		{"chat completions", "/v1/chat/completions", testStreamRequest, chatStream, "true", true},
+		{"chat completions without the header", "/v1/chat/completions", testStreamRequest, chatStream, "", false},
+		{"responses", "/v1/responses", `{"model":"gpt-4","stream":true,"input":"Hi"}`, responsesStream, "true", true},
+		{"responses without the header", "/v1/responses", `{"model":"gpt-4","stream":true,"input":"Hi"}`, responsesStream, "false", false},
+		{"non-streamed", "/v1/chat/completions", testChatRequest, testCompletion, "true", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, tt.response)
+			})
+			_, proxy, pool := newTestProxy(t, testServerConfig(upstream.URL))
+			if err := setUserKey(getTestConn(t, pool), "alice", "k1", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			var header map[string]string
+			if tt.header != "" {
+				header = map[string]string{"X-Proxy-Usage-Event": tt.header}
+			}
+			status, body := postJSONWithHeaders(t, proxy.URL+tt.path, "k1", header, tt.request)
+			if status != http.StatusOK {
+				t.Fatalf("got %d %s, want 200", status, body)
+			}
+			want := tt.response
+			if tt.event {
+				want += event
+			}
+			if body != want {
+				t.Errorf("got %q, want %q", body, want)
+			}
+		})
+	}
+}
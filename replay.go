@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stored request bodies can be replayed against a target, such as the
+// proxy in front of a fake upstream, to see how it copes with the
+// recorded traffic at a chosen rate.
+
+// replayPath returns the path the stored body was sent to, or false for
+// bodies that can't be replayed. Only the body is stored, so the endpoint
+// is guessed from its shape. Transcriptions are multipart forms whose
+// boundary is not stored and are never replayed.
+func replayPath(body []byte) (string, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return "", false
+	}
+	if _, ok := fields["messages"]; ok {
+		return "/v1/chat/completions", true
+	}
+	if _, ok := fields["input"]; ok {
+		return responsesPath, true
+	}
+	return "", false
+}
+
+type replayResult struct {
+	sent    int
+	failed  int
+	skipped int
+	// Responses by status code
+	statuses map[int]int
+	// Latencies of the requests that got a response, until its body ended
+	latencies []time.Duration
+}
+
+// percentile returns the latency that the fraction p of requests did not
+// exceed.
+func (r replayResult) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(r.latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return r.latencies[i]
+}
+
+// replay sends the stored requests to target, oldest first, starting rate
+// requests per second regardless of how long earlier ones take. Requests
+// are marked with X-Test, so that targets recording usage leave it out of
+// reports, and sent for their recorded project.
+func replay(client *http.Client, target, key string, requests []request, rate float64) replayResult {
+	res := replayResult{statuses: map[int]int{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	interval := time.Duration(float64(time.Second) / rate)
+	next := time.Now()
+	for i := len(requests) - 1; i >= 0; i-- {
+		req := requests[i]
+		path, ok := replayPath(req.body)
+		if !ok {
+			res.skipped++
+			continue
+		}
+
+		time.Sleep(time.Until(next))
+		next = next.Add(interval)
+
+		httpReq, err := http.NewRequest(http.MethodPost, target+path, bytes.NewReader(req.body))
+		if err != nil {
+			res.failed++
+			continue
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		httpReq.Header.Set("X-Test", "true")
+		if key != "" {
+			httpReq.Header.Set("Authorization", "Bearer "+key)
+		}
+		if req.projectName != "<default>" {
+			httpReq.Header.Set("X-Project", req.projectName)
+		}
+
+		res.sent++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			resp, err := client.Do(httpReq)
+			if err == nil {
+				_, err = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			latency := time.Since(start)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				res.failed++
+				return
+			}
+			res.statuses[resp.StatusCode]++
+			res.latencies = append(res.latencies, latency)
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+	return res
+}
+
+func (r replayResult) print(w io.Writer) {
+	fmt.Fprintf(w, "Sent %d requests, %d failed, %d skipped\n", r.sent, r.failed, r.skipped)
+
+	var codes []int
+	for code := range r.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %d: %d\n", code, r.statuses[code])
+	}
+
+	if len(r.latencies) != 0 {
+		fmt.Fprintf(w, "Latency p50 %s, p90 %s, p99 %s, max %s\n",
+			r.percentile(0.5), r.percentile(0.9), r.percentile(0.99), r.latencies[len(r.latencies)-1])
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiktoken-go/tokenizer"
+)
+
+// Responses API (/v1/responses) support. Requests are authorized, limited
+// and recorded the same way as chat completions, only the body shapes
+// differ.
+
+const responsesPath = "/v1/responses"
+
+// responsesInput collects the texts of a Responses API input, which is
+// either a string or a list of items whose content is either a string or a
+// list of content parts. Items without content and parts without text,
+// such as images and files, are skipped: they are upstream's to validate.
+type responsesInput []string
+
+func (in *responsesInput) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		*in = responsesInput{text}
+		return nil
+	}
+
+	var items []struct {
+		Content json.RawMessage
+	}
+	if err := json.Unmarshal(b, &items); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if len(item.Content) == 0 || string(item.Content) == "null" {
+			continue
+		}
+		var text string
+		if err := json.Unmarshal(item.Content, &text); err == nil {
+			*in = append(*in, text)
+			continue
+		}
+		var parts []json.RawMessage
+		if err := json.Unmarshal(item.Content, &parts); err != nil {
+			continue
+		}
+		for _, part := range parts {
+			var textPart struct {
+				Text *string
+			}
+			if err := json.Unmarshal(part, &textPart); err != nil || textPart.Text == nil {
+				continue
+			}
+			*in = append(*in, *textPart.Text)
+		}
+	}
+	return nil
+}
+
+type responsesStreamedEvent struct {
+	Type     string
+	Delta    string
+	Response struct {
+		Usage responseUsage
+	}
+}
+
+func proxyResponsesSSEResponse(w http.ResponseWriter, l *reqLogger, resp *http.Response, crb completionRequestBody, tk tokenizer.Codec, maxDuration time.Duration, flushPerEvent, sendUsage bool) requestUsage {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		l.Error("Unable to get flusher for response")
+		httpError(w, "Streaming setup failed", http.StatusInternalServerError)
+		return requestUsage{}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// The final event (response.completed, response.incomplete or
+	// response.failed) carries the usage. The text deltas are only kept
+	// to estimate usage if the stream ends before that.
+	var usage responseUsage
+	var deltas []string
+
+	var durationExceeded atomic.Bool
+	if maxDuration != 0 {
+		timer := time.AfterFunc(maxDuration, func() {
+			durationExceeded.Store(true)
+			resp.Body.Close()
+		})
+		defer timer.Stop()
+	}
+
+	// Unlike chat completions there is no [DONE] sentinel, the stream ends
+	// when upstream closes it. As the status is already sent, errors are
+	// only logged and end the stream.
+	reader := bufio.NewReader(resp.Body)
+	eof := false
+stream:
+	for !eof {
+		var msg string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil && durationExceeded.Load() {
+				l.Error("Stream exceeded %s, closing it", maxDuration)
+				break stream
+			}
+			if err != nil && err != io.EOF {
+				l.Error("Failed to read response body: %v", err)
+				break stream
+			}
+			fmt.Fprint(w, line)
+			if !flushPerEvent || line == "\n" || err == io.EOF {
+				flusher.Flush()
+			}
+
+			if strings.HasPrefix(line, "data:") {
+				msg += strings.TrimSpace(line[5:])
+			}
+
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if line == "\n" {
+				// End of event
+				break
+			}
+		}
+
+		if msg == "" {
+			continue
+		}
+
+		var event responsesStreamedEvent
+		if err := json.Unmarshal([]byte(msg), &event); err != nil {
+			l.Error("Failed to unmarshal response event, skipping it: %v", err)
+			continue
+		}
+
+		switch event.Type {
+		case "response.output_text.delta":
+			deltas = append(deltas, event.Delta)
+		case "response.completed", "response.incomplete", "response.failed":
+			usage = event.Response.Usage
+		}
+	}
+
+	ru := responsesStreamUsage(l, usage, deltas, crb, tk)
+	if sendUsage {
+		writeUsageEvent(w, flusher, l, proxyUsage{
+			PromptTokens:     ru.promptTokens,
+			CompletionTokens: ru.tokens - ru.promptTokens,
+			TotalTokens:      ru.tokens,
+			Estimated:        usage.tokens() == 0,
+		})
+	}
+	return ru
+}
+
+// responsesStreamUsage returns the usage reported in a Responses API
+// stream, or estimates it from the deltas if the stream ended without it.
+func responsesStreamUsage(l *reqLogger, usage responseUsage, deltas []string, crb completionRequestBody, tk tokenizer.Codec) requestUsage {
+	if nTokens := usage.tokens(); nTokens != 0 {
+		l.Info("SSE response read, tokens %d", nTokens)
+		return usage.usage()
+	}
+
+	if len(deltas) == 0 {
+		l.Info("SSE response without usage or deltas, not saving usage")
+		return requestUsage{}
+	}
+
+	// Best effort, like in proxySSEResponse
+	prompt, err := countPromptTokens(tk, crb)
+	if err != nil {
+		l.Error("Failed to tokenize prompt, not counting it: %v", err)
+	}
+	nTokens := prompt + countCompletionTokens(l, tk, deltas)
+	l.Info("SSE response ended without usage, estimated tokens %d", nTokens)
+
+	return requestUsage{tokens: nTokens, promptTokens: prompt}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+)
+
+// Audio transcriptions (/v1/audio/transcriptions) support. Requests are
+// multipart forms carrying the audio file, so only the form fields needed
+// for accounting are read and the body is proxied as is.
+
+const transcriptionsPath = "/v1/audio/transcriptions"
+
+// Responses in these formats carry no usage to record
+var errTranscriptionFormat = errors.New("response_format carries no usage, use json or verbose_json")
+
+// parseTranscriptionRequest reads the model and stream fields of a
+// multipart transcription request. Response formats without usage are
+// rejected, so that every transcription is accounted for.
+func parseTranscriptionRequest(contentType string, body []byte) (completionRequestBody, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return completionRequestBody{}, fmt.Errorf("failed to parse content type: %w", err)
+	}
+	if mediaType != "multipart/form-data" {
+		return completionRequestBody{}, fmt.Errorf("unexpected content type %q", mediaType)
+	}
+
+	var crb completionRequestBody
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return completionRequestBody{}, fmt.Errorf("failed to read form: %w", err)
+		}
+		switch part.FormName() {
+		case "model":
+			v, err := io.ReadAll(part)
+			if err != nil {
+				return completionRequestBody{}, fmt.Errorf("failed to read model: %w", err)
+			}
+			crb.Model = string(v)
+		case "stream":
+			v, err := io.ReadAll(part)
+			if err != nil {
+				return completionRequestBody{}, fmt.Errorf("failed to read stream: %w", err)
+			}
+			if crb.Stream, err = strconv.ParseBool(string(v)); err != nil {
+				return completionRequestBody{}, fmt.Errorf("invalid stream %q", v)
+			}
+		case "response_format":
+			v, err := io.ReadAll(part)
+			if err != nil {
+				return completionRequestBody{}, fmt.Errorf("failed to read response_format: %w", err)
+			}
+			switch string(v) {
+			case "text", "srt", "vtt":
+				return completionRequestBody{}, fmt.Errorf("%w: %s", errTranscriptionFormat, v)
+			}
+		}
+	}
+	if crb.Model == "" {
+		return completionRequestBody{}, errors.New("model is missing")
+	}
+	return crb, nil
+}
+
+// Models billed by tokens report them in usage, those billed by audio
+// duration report seconds, either in usage or, in verbose_json responses,
+// as duration.
+type transcriptionResponseBody struct {
+	Usage struct {
+		responseUsage
+		Type    string
+		Seconds float64
+	}
+	Duration float64
+}
+
+// usage returns the tokens, or the seconds of audio rounded up, used by
+// the transcription.
+func (b transcriptionResponseBody) usage() requestUsage {
+	switch {
+	case b.Usage.Type == "duration":
+		return requestUsage{audioSeconds: int(math.Ceil(b.Usage.Seconds))}
+	case b.Usage.tokens() != 0:
+		return requestUsage{tokens: b.Usage.tokens()}
+	default:
+		return requestUsage{audioSeconds: int(math.Ceil(b.Duration))}
+	}
+}
+
+func proxyTranscriptionResponse(w http.ResponseWriter, l *reqLogger, resp *http.Response, maxSize int) requestUsage {
+	responseBody, ok := readPlainResponseOrFail(w, l, resp, maxSize)
+	if !ok {
+		return requestUsage{}
+	}
+
+	// Formats without usage are rejected before proxying, so this is an
+	// upstream that does not report it
+	var ru requestUsage
+	var trespb transcriptionResponseBody
+	if err := json.Unmarshal(responseBody, &trespb); err != nil {
+		l.Error("Transcription response is not JSON, not saving usage: %v", err)
+	} else {
+		ru = trespb.usage()
+		l.Info("200 response read, tokens %d, audio seconds %d", ru.tokens, ru.audioSeconds)
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(responseBody)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(responseBody); err != nil {
+		l.Error("Failed to write response body: %v", err)
+	}
+
+	l.Info("200 response sent")
+
+	return ru
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Hardened deployments can restrict the certificates accepted from
+// upstream, so that a MITM on the upstream path fails the connection
+// instead of seeing the upstream key.
+
+// parsePin parses a pin of a certificate public key: the base64 SHA-256 of
+// its DER-encoded SubjectPublicKeyInfo, optionally prefixed with sha256//
+// as in curl --pinnedpubkey.
+func parsePin(pin string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256//"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pin %q: %w", pin, err)
+	}
+	if len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin %q: not a SHA-256 hash", pin)
+	}
+	return b, nil
+}
+
+// upstreamTLSConfig returns the TLS configuration of upstream connections.
+// If caFile is not empty, the PEM certificates in it are the only roots
+// trusted instead of the system pool. If pins are given, a verified chain
+// must also contain a certificate with one of the pinned public keys,
+// which may be the leaf, an intermediate or the root. It returns nil if
+// neither is given.
+func upstreamTLSConfig(caFile string, pins []string) (*tls.Config, error) {
+	if caFile == "" && len(pins) == 0 {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	if len(pins) != 0 {
+		pinned := map[[sha256.Size]byte]bool{}
+		for _, pin := range pins {
+			b, err := parsePin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pinned[*(*[sha256.Size]byte)(b)] = true
+		}
+		// Called after the usual verification, so the chains are verified
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					if pinned[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+						return nil
+					}
+				}
+			}
+			return errors.New("upstream certificate does not match any pin")
+		}
+	}
+
+	return config, nil
+}
+
+// upstreamTransport returns the transport of upstream requests using
+// config, or nil for the default transport if config is nil.
+func upstreamTransport(config *tls.Config) http.RoundTripper {
+	if config == nil {
+		return nil
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = config
+	return t
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type cachedUser struct {
+	key     string
+	id      int64
+	name    string
+	expired bool
+	added   time.Time
+}
+
+// userCache is a bounded LRU cache of successful user key lookups. Entries
+// expire after ttl, so changes made outside this process (CLI commands on
+// the same database) are picked up within ttl. Changes made through the
+// admin API clear the cache immediately.
+//
+// Unknown keys are not cached: new keys work immediately, and requests with
+// random keys can't evict the real ones.
+type userCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newUserCache(size int, ttl time.Duration) *userCache {
+	return &userCache{
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+func (c *userCache) get(key string) (cachedUser, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entries[key]
+	if e == nil {
+		return cachedUser{}, false
+	}
+	u := e.Value.(cachedUser)
+	if time.Since(u.added) >= c.ttl {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return cachedUser{}, false
+	}
+	c.lru.MoveToFront(e)
+	return u, true
+}
+
+func (c *userCache) add(u cachedUser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	u.added = time.Now()
+	if e := c.entries[u.key]; e != nil {
+		e.Value = u
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[u.key] = c.lru.PushFront(u)
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(cachedUser).key)
+	}
+}
+
+func (c *userCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+}